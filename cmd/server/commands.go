@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"fidi/internal/config"
+	"fidi/internal/storage"
+)
+
+const usage = `usage: fidi [command]
+
+Without a command the web server is started.
+
+commands:
+  export [-credentials] [file]  write the configuration as JSON, to stdout without a file
+  import [-overwrite] <file>    restore a configuration export ("-" reads stdin)
+  backup [dir]                  copy the SQLite database, to BACKUP_DIR by default
+  rotate-key                    re-encrypt sensitive values with the first DB_ENCRYPTION_KEY`
+
+// runCommand runs a maintenance command against the database
+func runCommand(cfg *config.Config, db storage.Store, name string, args []string) error {
+	switch name {
+	case "export":
+		return exportCommand(db, args)
+	case "import":
+		return importCommand(db, args)
+	case "backup":
+		dir := cfg.BackupDir
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		if dir == "" {
+			return errors.New("give a directory or set BACKUP_DIR")
+		}
+		file, err := db.BackupTo(dir, cfg.BackupKeep)
+		if err == nil {
+			fmt.Println(file)
+		}
+		return err
+	case "rotate-key":
+		_, err := db.RotateKey()
+		return err
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	}
+	return fmt.Errorf("unknown command\n%s", usage)
+}
+
+func exportCommand(db storage.Store, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	credentials := flags.Bool("credentials", false, "include the credentials saved on the settings page")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	archive, err := db.Export(*credentials)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if name := flags.Arg(0); name != "" && name != "-" {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(archive); err != nil {
+		return err
+	}
+	log.Printf("Exported %d settings, %d mappings, %d imported transactions", len(archive.Settings), len(archive.Mappings), len(archive.Imported))
+	return nil
+}
+
+func importCommand(db storage.Store, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	overwrite := flags.Bool("overwrite", false, "replace mappings, settings and records that already exist")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("give the export file to import")
+	}
+
+	var in io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var archive storage.Archive
+	if err := json.NewDecoder(in).Decode(&archive); err != nil {
+		return fmt.Errorf("not a valid export: %w", err)
+	}
+	report, err := db.Restore(&archive, *overwrite)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored %d settings, %d mappings, %d imported transactions and %d repayments",
+		report.Settings, report.Mappings, report.Imported, report.RepaymentLegs)
+	for _, line := range report.Kept() {
+		log.Print(line)
+	}
+	for _, note := range report.Notes {
+		log.Print(note)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"fidi/internal/config"
 	"fidi/internal/server"
@@ -14,26 +15,57 @@ func main() {
 	// 1. Load Configuration
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if cfg.File != "" {
+		log.Printf("Read configuration from %s", cfg.File)
 	}
-
 	// 2. Initialize Database
-	db, err := storage.New(cfg.DatabasePath)
+	dsn := cfg.DatabasePath
+	if cfg.DatabaseDriver == storage.DriverPostgres {
+		dsn = cfg.DatabaseURL
+	}
+	keys, err := storage.ParseKeyring(cfg.EncryptionKey)
+	if err != nil {
+		log.Fatalf("Invalid DB_ENCRYPTION_KEY: %v", err)
+	}
+	db, err := storage.Open(cfg.DatabaseDriver, dsn, storage.Options{LegacyWipe: cfg.LegacyWipe, Keys: keys})
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
+	// Maintenance commands, e.g. "fidi export", run and exit
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, db, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	// Settings saved on the settings page fill in what the environment and
+	// config file leave out
+	stored, err := server.StoredSettings(db)
+	if err != nil {
+		log.Fatalf("Failed to read settings: %v", err)
+	}
+	if cfg, err = config.LoadWith(stored); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if missing := cfg.Missing(); len(missing) > 0 {
+		log.Fatalf("Missing configuration: %s must be set in the environment or config file, or saved on the settings page",
+			strings.Join(missing, ", "))
+	}
+
 	// 3. Initialize Server
 	srv := server.New(cfg, db)
 
 	// 4. Start Server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "80"
-	}
-	log.Printf("Starting server on port %s", port)
-	if err := http.ListenAndServe(":"+port, srv); err != nil {
+	log.Printf("Starting server on port %s", cfg.Port)
+	if err := http.ListenAndServe(":"+cfg.Port, srv); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
@@ -2,7 +2,12 @@ module fidi
 
 go 1.24.3
 
-require modernc.org/sqlite v1.44.2
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/lib/pq v1.10.9
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.44.2
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
@@ -19,6 +19,9 @@ type Client struct {
 	HTTPClient *http.Client
 	Token      string
 	TokenExp   time.Time
+
+	// OnPage, if set, is called after each page of transactions is fetched
+	OnPage func(accountID string, page, count int)
 }
 
 func New(apiKey string) *Client {
@@ -0,0 +1,28 @@
+package basiq
+
+import (
+	"fmt"
+	"io"
+)
+
+// RefreshConnections asks Basiq to fetch fresh data from every bank the
+// user has connected. The refresh itself runs asynchronously at Basiq.
+func (c *Client) RefreshConnections(userID string) error {
+	req, err := c.newRequest("POST", fmt.Sprintf("/users/%s/connections/refresh", userID), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("refresh connections failed: %s - %s", resp.Status, string(body))
+	}
+
+	return nil
+}
@@ -2,8 +2,10 @@ package basiq
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 type Account struct {
@@ -57,6 +59,14 @@ type Transaction struct {
 	PostDate    string `json:"postDate"`
 	Account     string `json:"account"` // Account ID
 	Balance     string `json:"balance"`
+	Status      string `json:"status"` // posted/pending
+	// Class is Basiq's classification, e.g. payment, transfer, bank-fee,
+	// interest, loan-interest, loan-repayment, refund
+	Class    string `json:"class"`
+	SubClass struct {
+		Code  string `json:"code"`
+		Title string `json:"title"`
+	} `json:"subClass"`
 }
 
 type TransactionListResponse struct {
@@ -67,60 +77,89 @@ type TransactionListResponse struct {
 }
 
 func (c *Client) GetTransactions(userID, accountID string, since string) ([]Transaction, error) {
-	// Filter syntax might vary, assuming simple filter or no filter for now.
-	// Basiq supports 'filter=account.id.eq(...)'.
-	// To get all transactions since X, we might need 'filter=postDate.gt(...)'.
+	return c.GetTransactionsRange(userID, accountID, since, "")
+}
+
+// maxTransactionPages stops a fetch that keeps being handed more pages
+const maxTransactionPages = 1000
+
+// ErrTruncated means a fetch stopped before the last page. The
+// transactions fetched so far are returned along with it.
+var ErrTruncated = errors.New("not all transactions could be fetched")
 
+// GetTransactionsRange fetches transactions posted after since and up to
+// and including until, following links.next through every page. Either
+// bound may be empty.
+func (c *Client) GetTransactionsRange(userID, accountID, since, until string) ([]Transaction, error) {
 	path := fmt.Sprintf("/users/%s/transactions?filter=account.id.eq('%s')", userID, accountID)
 	if since != "" {
 		path += fmt.Sprintf(",postDate.gt('%s')", since)
 	}
-	// Also want to limit or paginate? For now just one page or handle pagination loop.
-	// Let's implement basic pagination loop.
+	if until != "" {
+		path += fmt.Sprintf(",postDate.lteq('%s')", until)
+	}
 
 	var allTx []Transaction
-
-	for path != "" {
-		req, err := c.newRequest("GET", path, nil)
-		if err != nil {
-			return nil, err
+	seen := make(map[string]bool)
+	for page := 1; path != ""; page++ {
+		if page > maxTransactionPages {
+			return allTx, fmt.Errorf("%w: more than %d pages", ErrTruncated, maxTransactionPages)
 		}
-
-		resp, err := c.HTTPClient.Do(req)
+		seen[path] = true
+		list, err := c.getTransactionPage(path)
 		if err != nil {
 			return nil, err
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode > 299 {
-			body, _ := io.ReadAll(resp.Body)
-			return nil, fmt.Errorf("get transactions failed: %s - %s", resp.Status, string(body))
+		allTx = append(allTx, list.Data...)
+		if c.OnPage != nil {
+			c.OnPage(accountID, page, len(list.Data))
 		}
 
-		var list TransactionListResponse
-		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
-			return nil, err
+		next, err := nextPath(list.Links.Next)
+		if err != nil {
+			return allTx, fmt.Errorf("%w: %v", ErrTruncated, err)
 		}
+		if seen[next] {
+			return allTx, fmt.Errorf("%w: page %d links back to an earlier page", ErrTruncated, page)
+		}
+		path = next
+	}
+	return allTx, nil
+}
 
-		allTx = append(allTx, list.Data...)
+func (c *Client) getTransactionPage(path string) (*TransactionListResponse, error) {
+	req, err := c.newRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-		// Handle pagination
-		if list.Links.Next != "" {
-			// Basiq usually returns full URL in Next, or relative?
-			// Documentation says it returns relative or absolute.
-			// Assuming absolute for now, but if it starts with https, we need to handle it.
-			// If it's just path, we prepend.
-			// Actually Basiq "links.next" is usually the full URL.
-			// But our newRequest takes a path relative to API Base.
-			// We should probably handle this better.
-			// For simplicity/MVP: Just break after first page (500 items usually).
-			// Or check if user wants full history.
-			// Let's grab at least 500.
-			break // For MVP/Simplicity
-		} else {
-			break
-		}
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("get transactions failed: %s - %s", resp.Status, string(body))
 	}
+	var list TransactionListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
 
-	return allTx, nil
+// nextPath turns links.next, a full URL or a path, into a path for
+// newRequest. The token is only ever sent to the Basiq API.
+func nextPath(next string) (string, error) {
+	if next == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(next, "/") {
+		return next, nil
+	}
+	if rest, ok := strings.CutPrefix(next, BasiqAPIURL); ok && (rest == "" || strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, "?")) {
+		return rest, nil
+	}
+	return "", fmt.Errorf("next page %q is not on %s", next, BasiqAPIURL)
 }
@@ -0,0 +1,20 @@
+package basiq
+
+import "testing"
+
+func TestNextPath(t *testing.T) {
+	for _, tc := range []struct{ next, want string }{
+		{"", ""},
+		{"/users/u1/transactions?next=abc", "/users/u1/transactions?next=abc"},
+		{BasiqAPIURL + "/users/u1/transactions?next=abc", "/users/u1/transactions?next=abc"},
+	} {
+		if got, err := nextPath(tc.next); err != nil || got != tc.want {
+			t.Errorf("nextPath(%q) = %q, %v, want %q", tc.next, got, err, tc.want)
+		}
+	}
+	for _, next := range []string{"https://evil.example/users/u1/transactions", BasiqAPIURL + ".evil.example/x", "users/u1"} {
+		if got, err := nextPath(next); err == nil {
+			t.Errorf("nextPath(%q) = %q, want an error", next, got)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package basiq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type Institution struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	ShortName string `json:"shortName"`
+}
+
+// GetInstitution returns the bank an account belongs to
+func (c *Client) GetInstitution(id string) (*Institution, error) {
+	req, err := c.newRequest("GET", "/institutions/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("get institution failed: %s - %s", resp.Status, string(body))
+	}
+
+	var inst Institution
+	if err := json.NewDecoder(resp.Body).Decode(&inst); err != nil {
+		return nil, err
+	}
+	return &inst, nil
+}
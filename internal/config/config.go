@@ -1,27 +1,282 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fidi/internal/schedule"
 )
 
 type Config struct {
-	DatabasePath        string
-	BasiqAPIKey         string
-	FireflyURL          string
-	FireflyAccessToken  string
+	// File is the config file that was read, if any.
+	File string
+	// Port is the port the web interface listens on.
+	Port string
+	// DatabaseDriver is "sqlite" or "postgres".
+	DatabaseDriver string
+	DatabasePath   string
+	// DatabaseURL is the PostgreSQL connection string.
+	DatabaseURL string
+	// LegacyWipe drops the tables of the old PHP importer on startup.
+	LegacyWipe bool
+	// EncryptionKey holds the keys sensitive values are encrypted with,
+	// comma separated, the first one current. Empty disables encryption.
+	EncryptionKey      string
+	BasiqAPIKey        string
+	FireflyURL         string
+	FireflyAccessToken string
+	// SyncSchedule is the cron expression for the global sync schedule.
+	SyncSchedule string
+	// Timezone is the IANA zone schedules are evaluated in.
+	Timezone string
+	// JobWorkers is the number of background workers processing the job queue.
+	JobWorkers int
+	// SyncAccountWorkers is how many accounts are synced in parallel.
+	SyncAccountWorkers int
+	// BasiqConcurrency and FireflyConcurrency cap the number of requests in
+	// flight to each provider, shared by all running syncs.
+	BasiqConcurrency   int
+	FireflyConcurrency int
+	// RunTag is added to every transaction a sync run creates. {time} is
+	// replaced with the start of the run, empty disables tagging.
+	RunTag string
+	// OverlapDays is how far before the cursor each sync looks again for
+	// transactions the bank changed after they were imported.
+	OverlapDays int
+	// ChangedTransactions is "update" to apply bank changes to Firefly, or
+	// "review" to hold them for approval.
+	ChangedTransactions string
+	// VanishedTransactions is what happens to imported transactions Basiq
+	// stops returning or that were reversed: "review", "tag" or "delete".
+	VanishedTransactions string
+	// MatchExisting links new Basiq transactions to matching transactions
+	// entered by hand in Firefly instead of creating duplicates.
+	MatchExisting bool
+	// MatchToleranceDays is how far apart the dates of a match may be.
+	MatchToleranceDays int
+	// BackupDir is where scheduled SQLite backups go, empty for none.
+	BackupDir string
+	// BackupSchedule is the cron expression backups are taken on.
+	BackupSchedule string
+	// BackupKeep is how many backups are kept.
+	BackupKeep int
+
+	settings []Setting
+}
+
+// Editable are the settings that can be changed on the settings page. The
+// values are stored in the database and only used when neither the
+// environment nor the config file sets them.
+var Editable = []string{
+	"FIREFLY_III_URL", "FIREFLY_III_ACCESS_TOKEN", "BASIQ_API_KEY",
+	"SYNC_SCHEDULE", "SYNC_TIMEZONE", "SYNC_RUN_TAG", "SYNC_OVERLAP_DAYS",
+	"CHANGED_TRANSACTIONS", "VANISHED_TRANSACTIONS", "MATCH_EXISTING", "MATCH_TOLERANCE_DAYS",
+}
+
+var editable = make(map[string]bool)
+
+func init() {
+	for _, name := range Editable {
+		editable[name] = true
+	}
 }
 
+// Load reads the configuration from the environment, *_FILE secrets and a
+// YAML or TOML config file, in that order of precedence. Malformed values
+// are errors, missing required ones are left to Validate and Missing.
 func Load() (*Config, error) {
-	// Defaults
-	dbPath := "database/database.sqlite"
-	if os.Getenv("DB_PATH") != "" {
-		dbPath = os.Getenv("DB_PATH")
-	}
-
-	return &Config{
-		DatabasePath:       dbPath,
-		BasiqAPIKey:        os.Getenv("BASIQ_API_KEY"),
-		FireflyURL:         os.Getenv("FIREFLY_III_URL"),
-		FireflyAccessToken: os.Getenv("FIREFLY_III_ACCESS_TOKEN"),
-	}, nil
+	return LoadWith(nil)
+}
+
+// LoadWith is Load with the values stored from the settings page, keyed by
+// setting name, as the last source before the defaults
+func LoadWith(stored map[string]string) (*Config, error) {
+	l, err := newLoader(stored)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+
+	// DB_CONNECTION and DB_DATABASE are the names the PHP importer used
+	connection := l.get("sqlite", false, "DB_DRIVER", "DB_CONNECTION")
+	switch connection {
+	case "sqlite":
+		cfg.DatabaseDriver = "sqlite"
+	case "postgres", "pgsql":
+		cfg.DatabaseDriver = "postgres"
+	default:
+		l.errs = append(l.errs, fmt.Sprintf("DB_DRIVER must be sqlite or postgres, got %q", connection))
+	}
+	if cfg.DatabaseDriver == "postgres" {
+		cfg.DatabaseURL = l.secret("DATABASE_URL")
+		if cfg.DatabaseURL == "" {
+			cfg.DatabaseURL = postgresURL(l)
+		}
+	} else {
+		cfg.DatabasePath = l.get("database/database.sqlite", false, "DB_PATH", "DB_DATABASE")
+	}
+	cfg.LegacyWipe = l.bool("DB_LEGACY_WIPE", false)
+	cfg.EncryptionKey = l.secret("DB_ENCRYPTION_KEY")
+
+	cfg.BasiqAPIKey = l.secret("BASIQ_API_KEY")
+	cfg.FireflyURL = strings.TrimRight(l.str("FIREFLY_III_URL", ""), "/")
+	cfg.FireflyAccessToken = l.secret("FIREFLY_III_ACCESS_TOKEN")
+	cfg.Port = l.str("PORT", "80")
+
+	// Sync at 6am every day unless told otherwise
+	cfg.SyncSchedule = l.str("SYNC_SCHEDULE", "0 6 * * *")
+	// Fall back to the container's TZ, then to the process local zone. TZ
+	// is only the default so the settings page can still change it.
+	cfg.Timezone = l.str("SYNC_TIMEZONE", os.Getenv("TZ"))
+	cfg.JobWorkers = l.int("JOB_WORKERS", 2)
+	cfg.SyncAccountWorkers = l.int("SYNC_ACCOUNT_WORKERS", 4)
+	cfg.BasiqConcurrency = l.int("BASIQ_MAX_CONCURRENCY", 2)
+	cfg.FireflyConcurrency = l.int("FIREFLY_MAX_CONCURRENCY", 4)
+
+	// "none" switches run tags off
+	cfg.RunTag = l.str("SYNC_RUN_TAG", "fidi-{time}")
+	if cfg.RunTag == "none" {
+		cfg.RunTag = ""
+	}
+	cfg.OverlapDays = l.days("SYNC_OVERLAP_DAYS", 7)
+	cfg.ChangedTransactions = l.oneOf("CHANGED_TRANSACTIONS", "update", "review")
+	cfg.VanishedTransactions = l.oneOf("VANISHED_TRANSACTIONS", "review", "tag", "delete")
+	cfg.MatchExisting = l.bool("MATCH_EXISTING", true)
+	cfg.MatchToleranceDays = l.days("MATCH_TOLERANCE_DAYS", 3)
+
+	cfg.BackupDir = l.str("BACKUP_DIR", "")
+	cfg.BackupSchedule = l.str("BACKUP_SCHEDULE", "0 3 * * *")
+	cfg.BackupKeep = l.int("BACKUP_KEEP", 7)
+
+	l.unused()
+	cfg.File = l.fileName
+	cfg.settings = l.settings
+	if len(l.errs) > 0 {
+		return nil, errors.New(strings.Join(l.errs, "\n"))
+	}
+	return cfg, nil
+}
+
+// postgresURL builds a connection string from the Laravel style DB_HOST,
+// DB_PORT, DB_DATABASE, DB_USERNAME and DB_PASSWORD, empty if DB_HOST is
+// not set
+func postgresURL(l *loader) string {
+	host := l.str("DB_HOST", "")
+	port := l.str("DB_PORT", "5432")
+	name := l.str("DB_DATABASE", "fidi")
+	user := l.str("DB_USERNAME", "")
+	password := l.secret("DB_PASSWORD")
+	if host == "" {
+		return ""
+	}
+	u := url.URL{Scheme: "postgres", Host: host + ":" + port, Path: "/" + name}
+	if user != "" {
+		u.User = url.UserPassword(user, password)
+	}
+	return u.String()
+}
+
+// Missing lists the settings a sync needs that are not set anywhere. The
+// server refuses to start while any are missing, so the settings page can
+// only change them once they have been given some other way.
+func (c *Config) Missing() []string {
+	var missing []string
+	for _, s := range []struct{ name, value string }{
+		{"FIREFLY_III_URL", c.FireflyURL},
+		{"FIREFLY_III_ACCESS_TOKEN", c.FireflyAccessToken},
+		{"BASIQ_API_KEY", c.BasiqAPIKey},
+	} {
+		if s.value == "" {
+			missing = append(missing, s.name)
+		}
+	}
+	return missing
+}
+
+// Validate checks that the settings are well formed, listing every problem
+// at once
+func (c *Config) Validate() error {
+	var problems []string
+	if u, err := url.Parse(c.FireflyURL); c.FireflyURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		problems = append(problems, fmt.Sprintf("FIREFLY_III_URL must be an http(s) URL such as https://firefly.example.com, got %q", c.FireflyURL))
+	}
+
+	switch c.DatabaseDriver {
+	case "postgres":
+		if c.DatabaseURL == "" {
+			problems = append(problems, "DATABASE_URL (or DB_HOST) is required with DB_DRIVER=postgres")
+		}
+	default:
+		dir := filepath.Dir(c.DatabasePath)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("the directory of the database %s does not exist", c.DatabasePath))
+		}
+	}
+
+	if _, err := schedule.Parse(c.SyncSchedule); err != nil {
+		problems = append(problems, fmt.Sprintf("SYNC_SCHEDULE: %v", err))
+	}
+	if c.BackupDir != "" {
+		if _, err := schedule.Parse(c.BackupSchedule); err != nil {
+			problems = append(problems, fmt.Sprintf("BACKUP_SCHEDULE: %v", err))
+		}
+	}
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("unknown time zone %q", c.Timezone))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// RestartNeeded lists the settings that changed since started was loaded
+// but are only read at startup, such as the database and the number of
+// workers and requests in flight. Saving on the settings page reloads the
+// environment and config file too, so they may have changed meanwhile.
+func (c *Config) RestartNeeded(started *Config) []string {
+	var changed []string
+	for _, s := range []struct {
+		name     string
+		now, was interface{}
+	}{
+		{"PORT", c.Port, started.Port},
+		{"DB_DRIVER", c.DatabaseDriver, started.DatabaseDriver},
+		{"DB_PATH", c.DatabasePath, started.DatabasePath},
+		{"DATABASE_URL", c.DatabaseURL, started.DatabaseURL},
+		{"DB_LEGACY_WIPE", c.LegacyWipe, started.LegacyWipe},
+		{"DB_ENCRYPTION_KEY", c.EncryptionKey, started.EncryptionKey},
+		{"JOB_WORKERS", c.JobWorkers, started.JobWorkers},
+		{"BASIQ_MAX_CONCURRENCY", c.BasiqConcurrency, started.BasiqConcurrency},
+		{"FIREFLY_MAX_CONCURRENCY", c.FireflyConcurrency, started.FireflyConcurrency},
+	} {
+		if s.now != s.was {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
+
+// Effective lists the settings in effect and where each came from.
+// Secrets only show whether they are set.
+func (c *Config) Effective() []Setting {
+	return c.settings
+}
+
+// Setting returns a single setting of Effective
+func (c *Config) Setting(name string) Setting {
+	for _, s := range c.settings {
+		if s.Name == name {
+			return s
+		}
+	}
+	return Setting{Name: name, Source: SourceDefault}
 }
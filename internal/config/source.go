@@ -0,0 +1,249 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Where a setting's value came from
+const (
+	SourceDefault = "default"
+	SourceEnv     = "environment"
+	SourceSecret  = "secret file"
+	SourceFile    = "config file"
+	SourceStored  = "settings page"
+)
+
+// configFiles are looked for in the working directory when CONFIG_FILE
+// isn't set
+var configFiles = []string{"config.yaml", "config.yml", "config.toml"}
+
+// Setting is one configuration value as it is in effect, for diagnostics.
+// Secrets never carry their value.
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+	// From names the variable or file the value was read from when that
+	// isn't Name itself
+	From   string
+	Secret bool
+}
+
+// Locked tells whether the setting is fixed by the environment or the
+// config file, so the settings page can't change it
+func (s Setting) Locked() bool {
+	return s.Source == SourceEnv || s.Source == SourceSecret || s.Source == SourceFile
+}
+
+// loader reads settings from the environment, *_FILE secrets, the config
+// file and the values stored from the settings page, in that order of
+// precedence, and records problems
+type loader struct {
+	file     map[string]string
+	fileName string
+	stored   map[string]string
+	used     map[string]bool
+	settings []Setting
+	errs     []string
+}
+
+func newLoader(stored map[string]string) (*loader, error) {
+	l := &loader{stored: stored, used: make(map[string]bool)}
+	name := os.Getenv("CONFIG_FILE")
+	if name == "" {
+		for _, f := range configFiles {
+			if _, err := os.Stat(f); err == nil {
+				name = f
+				break
+			}
+		}
+	}
+	if name == "" {
+		return l, nil
+	}
+	file, err := readConfigFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", name, err)
+	}
+	l.file, l.fileName = file, name
+	return l, nil
+}
+
+// readConfigFile loads a YAML or TOML file. Keys are the environment
+// variable names, in any case; nested sections are joined with "_", so
+// firefly_iii: {url: ...} sets FIREFLY_III_URL.
+func readConfigFile(name string) (map[string]string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".toml":
+		err = toml.Unmarshal(b, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	default:
+		return nil, fmt.Errorf("unknown format, use .yaml or .toml")
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	flatten("", raw, values)
+	return values, nil
+}
+
+func flatten(prefix string, raw map[string]interface{}, values map[string]string) {
+	for k, v := range raw {
+		name := strings.ToUpper(k)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(name, v, values)
+		case []interface{}:
+			parts := make([]string, len(v))
+			for i, p := range v {
+				parts[i] = fmt.Sprint(p)
+			}
+			values[name] = strings.Join(parts, ",")
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+// lookup finds a setting. Empty environment variables count as unset.
+func (l *loader) lookup(name string) (value, source, from string, ok bool) {
+	l.used[name], l.used[name+"_FILE"] = true, true
+	if v := os.Getenv(name); v != "" {
+		return v, SourceEnv, "", true
+	}
+	if f := os.Getenv(name + "_FILE"); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Sprintf("%s_FILE: %v", name, err))
+			return "", "", "", false
+		}
+		return strings.TrimSpace(string(b)), SourceSecret, f, true
+	}
+	for _, key := range []string{name, name + "_FILE"} {
+		v, found := l.file[key]
+		if !found {
+			continue
+		}
+		if key == name {
+			return v, SourceFile, l.fileName, true
+		}
+		b, err := os.ReadFile(v)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Sprintf("%s in %s: %v", strings.ToLower(key), l.fileName, err))
+			return "", "", "", false
+		}
+		return strings.TrimSpace(string(b)), SourceSecret, v, true
+	}
+	if v, found := l.stored[name]; found && editable[name] {
+		return v, SourceStored, "", true
+	}
+	return "", "", "", false
+}
+
+// get returns the first of names that is set, or def
+func (l *loader) get(def string, secret bool, names ...string) string {
+	s := Setting{Name: names[0], Value: def, Source: SourceDefault, Secret: secret}
+	for _, name := range names {
+		if v, source, from, ok := l.lookup(name); ok {
+			s.Value, s.Source, s.From = v, source, from
+			if name != names[0] && from == "" {
+				s.From = name
+			}
+			break
+		}
+	}
+	value := s.Value
+	if secret {
+		s.Value = ""
+	}
+	l.settings = append(l.settings, s)
+	return value
+}
+
+func (l *loader) str(name, def string) string {
+	return l.get(def, false, name)
+}
+
+func (l *loader) secret(name string) string {
+	return l.get("", true, name)
+}
+
+// int reads a positive number
+func (l *loader) int(name string, def int) int {
+	v := l.str(name, strconv.Itoa(def))
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		l.errs = append(l.errs, fmt.Sprintf("%s must be a positive number, got %q", name, v))
+		return def
+	}
+	return n
+}
+
+// days reads a number of days, where 0 is allowed
+func (l *loader) days(name string, def int) int {
+	v := l.str(name, strconv.Itoa(def))
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		l.errs = append(l.errs, fmt.Sprintf("%s must be a number of days (0 or more), got %q", name, v))
+		return def
+	}
+	return n
+}
+
+func (l *loader) bool(name string, def bool) bool {
+	v := l.str(name, strconv.FormatBool(def))
+	switch strings.ToLower(v) {
+	case "true", "1", "yes", "on":
+		return true
+	case "false", "0", "no", "off":
+		return false
+	}
+	l.errs = append(l.errs, fmt.Sprintf("%s must be true or false, got %q", name, v))
+	return def
+}
+
+// oneOf reads a value that must be one of allowed, the first is the default
+func (l *loader) oneOf(name string, allowed ...string) string {
+	v := l.str(name, allowed[0])
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	l.errs = append(l.errs, fmt.Sprintf("%s must be one of %s, got %q", name, strings.Join(allowed, ", "), v))
+	return allowed[0]
+}
+
+// unused reports keys in the config file nothing read, most likely typos
+func (l *loader) unused() {
+	var keys []string
+	for k := range l.file {
+		if !l.used[k] {
+			keys = append(keys, strings.ToLower(k))
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		l.errs = append(l.errs, fmt.Sprintf("unknown setting %q in %s", k, l.fileName))
+	}
+}
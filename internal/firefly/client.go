@@ -3,12 +3,18 @@ package firefly
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// ErrDuplicate is returned when Firefly refuses a transaction because an
+// identical one already exists
+var ErrDuplicate = errors.New("duplicate transaction")
+
 type Client struct {
 	URL         string
 	AccessToken string
@@ -55,21 +61,121 @@ func (c *Client) newRequest(method, path string, body interface{}) (*http.Reques
 	return req, nil
 }
 
+// Account types accepted by the account listing filter
+const (
+	AccountTypeAsset       = "asset"
+	AccountTypeLiabilities = "liabilities"
+	AccountTypeExpense     = "expense"
+	AccountTypeRevenue     = "revenue"
+)
+
+// RoleCreditCard is the account role Firefly uses for credit card asset accounts
+const RoleCreditCard = "ccAsset"
+
 type Account struct {
-	ID         string `json:"id"`
-	Attributes struct {
-		Name          string `json:"name"`
-		Type          string `json:"type"`
-		CurrentBalance string `json:"current_balance"`
-	} `json:"attributes"`
+	ID         string            `json:"id"`
+	Attributes AccountAttributes `json:"attributes"`
+}
+
+type AccountAttributes struct {
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	AccountRole    string `json:"account_role"`
+	CurrencyCode   string `json:"currency_code"`
+	AccountNumber  string `json:"account_number"`
+	IBAN           string `json:"iban"`
+	Active         bool   `json:"active"`
+	LiabilityType  string `json:"liability_type"`
+	CurrentBalance string `json:"current_balance"`
+}
+
+// IsLiability reports whether the account is a debt, loan or mortgage
+func (a Account) IsLiability() bool {
+	t := strings.ToLower(a.Attributes.Type)
+	return t == "liability" || t == "liabilities" || a.Attributes.LiabilityType != ""
+}
+
+// IsCreditCard reports whether the account is a credit card, which Firefly
+// models as an asset account with the credit card role
+func (a Account) IsCreditCard() bool {
+	return a.Attributes.AccountRole == RoleCreditCard
+}
+
+type Pagination struct {
+	Total       int `json:"total"`
+	Count       int `json:"count"`
+	PerPage     int `json:"per_page"`
+	CurrentPage int `json:"current_page"`
+	TotalPages  int `json:"total_pages"`
+}
+
+type Meta struct {
+	Pagination Pagination `json:"pagination"`
 }
 
 type AccountListResponse struct {
 	Data []Account `json:"data"`
+	Meta Meta      `json:"meta"`
+}
+
+// GetAccounts returns every account of the given types, following
+// pagination. Without types, asset and liability accounts are returned.
+func (c *Client) GetAccounts(types ...string) ([]Account, error) {
+	if len(types) == 0 {
+		types = []string{AccountTypeAsset, AccountTypeLiabilities}
+	}
+
+	var all []Account
+	for _, t := range types {
+		accounts, err := c.getAccountsOfType(t)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, accounts...)
+	}
+	return all, nil
+}
+
+func (c *Client) getAccountsOfType(accountType string) ([]Account, error) {
+	var all []Account
+
+	for page := 1; ; page++ {
+		req, err := c.newRequest("GET", fmt.Sprintf("/accounts?type=%s&page=%d&limit=100", accountType, page), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode > 299 {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("firefly get accounts failed: %s - %s", resp.Status, string(body))
+		}
+
+		var list AccountListResponse
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, list.Data...)
+
+		if len(list.Data) == 0 || page >= list.Meta.Pagination.TotalPages {
+			break
+		}
+	}
+
+	return all, nil
 }
 
-func (c *Client) GetAccounts() ([]Account, error) {
-	req, err := c.newRequest("GET", "/accounts?type=asset", nil)
+// GetAccount returns a single account, including its current balance
+func (c *Client) GetAccount(id string) (*Account, error) {
+	req, err := c.newRequest("GET", "/accounts/"+id, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -82,44 +188,191 @@ func (c *Client) GetAccounts() ([]Account, error) {
 
 	if resp.StatusCode > 299 {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("firefly get accounts failed: %s - %s", resp.Status, string(body))
+		return nil, fmt.Errorf("firefly get account failed: %s - %s", resp.Status, string(body))
 	}
 
-	var list AccountListResponse
-	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+	var account accountResponse
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
 		return nil, err
 	}
+	return &account.Data, nil
+}
 
-	return list.Data, nil
+// About is the version information of the Firefly III instance
+type About struct {
+	Version    string `json:"version"`
+	APIVersion string `json:"api_version"`
+}
+
+// About fetches the version of Firefly III, which also checks the token
+func (c *Client) About() (*About, error) {
+	req, err := c.newRequest("GET", "/about", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("firefly about failed: %s - %s", resp.Status, string(body))
+	}
+
+	var about struct {
+		Data About `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&about); err != nil {
+		return nil, err
+	}
+	return &about.Data, nil
+}
+
+// User is the Firefly III user an access token belongs to. Demo users can
+// only read.
+type User struct {
+	Email   string `json:"email"`
+	Blocked bool   `json:"blocked"`
+	Role    string `json:"role"`
+}
+
+// AboutUser fetches the user the access token belongs to
+func (c *Client) AboutUser() (*User, error) {
+	req, err := c.newRequest("GET", "/about/user", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("firefly about user failed: %s - %s", resp.Status, string(body))
+	}
+
+	var user struct {
+		Data struct {
+			Attributes User `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user.Data.Attributes, nil
+}
+
+// AccountRequest is the payload for creating an account. Asset accounts
+// need a role, liabilities a type and direction.
+type AccountRequest struct {
+	Name               string `json:"name"`
+	Type               string `json:"type"` // asset, liability
+	AccountRole        string `json:"account_role,omitempty"`
+	CurrencyCode       string `json:"currency_code,omitempty"`
+	AccountNumber      string `json:"account_number,omitempty"`
+	OpeningBalance     string `json:"opening_balance,omitempty"`
+	OpeningBalanceDate string `json:"opening_balance_date,omitempty"`
+	CreditCardType     string `json:"credit_card_type,omitempty"`
+	MonthlyPaymentDate string `json:"monthly_payment_date,omitempty"`
+	LiabilityType      string `json:"liability_type,omitempty"`
+	LiabilityDirection string `json:"liability_direction,omitempty"`
+	Interest           string `json:"interest,omitempty"`
+	InterestPeriod     string `json:"interest_period,omitempty"`
+	Notes              string `json:"notes,omitempty"`
+	Active             bool   `json:"active"`
+}
+
+type accountResponse struct {
+	Data Account `json:"data"`
+}
+
+// CreateAccount creates an account and returns it as stored by Firefly
+func (c *Client) CreateAccount(account AccountRequest) (*Account, error) {
+	req, err := c.newRequest("POST", "/accounts", account)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("firefly create account failed: %s - %s", resp.Status, string(body))
+	}
+
+	var created accountResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return nil, err
+	}
+	return &created.Data, nil
 }
 
 type Transaction struct {
-	Type          string `json:"type"` // withdrawal, deposit
-	Date          string `json:"date"`
-	Amount        string `json:"amount"`
-	Description   string `json:"description"`
-	SourceID      string `json:"source_id,omitempty"`
-	DestinationID string `json:"destination_id,omitempty"`
-	ExternalID    string `json:"external_id,omitempty"` // Use for dedup
+	Type            string   `json:"type"` // withdrawal, deposit, transfer
+	Date            string   `json:"date"`
+	Amount          string   `json:"amount"`
+	Description     string   `json:"description"`
+	SourceID        string   `json:"source_id,omitempty"`
+	SourceName      string   `json:"source_name,omitempty"`
+	DestinationID   string   `json:"destination_id,omitempty"`
+	DestinationName string   `json:"destination_name,omitempty"`
+	CategoryName    string   `json:"category_name,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	Reconciled      bool     `json:"reconciled,omitempty"`
+	ExternalID      string   `json:"external_id,omitempty"` // Use for dedup
 }
 
 type TransactionPayload struct {
-	Transactions []Transaction `json:"transactions"`
+	ErrorIfDuplicateHash bool          `json:"error_if_duplicate_hash"`
+	Transactions         []Transaction `json:"transactions"`
+}
+
+// CreatedTransaction identifies a transaction stored in Firefly. Every
+// transaction we create is a group with a single journal.
+type CreatedTransaction struct {
+	GroupID   string
+	JournalID string
+	// Tags the transaction ended up with, rules may have added some
+	Tags []string
+}
+
+type transactionGroupResponse struct {
+	Data struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			Transactions []struct {
+				JournalID string   `json:"transaction_journal_id"`
+				Tags      []string `json:"tags"`
+			} `json:"transactions"`
+		} `json:"attributes"`
+	} `json:"data"`
 }
 
-func (c *Client) CreateTransaction(tx Transaction) error {
+func (c *Client) CreateTransaction(tx Transaction) (*CreatedTransaction, error) {
+	// Ask Firefly to reject duplicates so overlapping syncs are harmless
 	payload := TransactionPayload{
-		Transactions: []Transaction{tx},
+		ErrorIfDuplicateHash: true,
+		Transactions:         []Transaction{tx},
 	}
 
 	req, err := c.newRequest("POST", "/transactions", payload)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -129,13 +382,208 @@ func (c *Client) CreateTransaction(tx Transaction) error {
 		// Or maybe success but with warning.
 		// For now, treat 422 as error but log body.
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("validation error (duplicate?): %s", string(body))
+		if strings.Contains(string(body), "Duplicate of transaction") {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicate, string(body))
+		}
+		return nil, fmt.Errorf("validation error (duplicate?): %s", string(body))
+	}
+
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("create transaction failed: %s - %s", resp.Status, string(body))
 	}
 
+	// The transaction exists even if the response can't be read, so that
+	// is not an error, the IDs are just unknown
+	var group transactionGroupResponse
+	json.NewDecoder(resp.Body).Decode(&group)
+	created := &CreatedTransaction{GroupID: group.Data.ID}
+	if len(group.Data.Attributes.Transactions) > 0 {
+		created.JournalID = group.Data.Attributes.Transactions[0].JournalID
+		created.Tags = group.Data.Attributes.Transactions[0].Tags
+	}
+	return created, nil
+}
+
+// DeleteTransaction deletes a transaction group. Deleting one that is
+// already gone is not an error.
+func (c *Client) DeleteTransaction(groupID string) error {
+	req, err := c.newRequest("DELETE", "/transactions/"+groupID, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("delete transaction failed: %s - %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+// TransactionSplit is a transaction as stored in Firefly
+type TransactionSplit struct {
+	JournalID   string   `json:"transaction_journal_id"`
+	Type        string   `json:"type"`
+	Date        string   `json:"date"`
+	Amount      string   `json:"amount"`
+	Description string   `json:"description"`
+	SourceID    string   `json:"source_id"`
+	DestID      string   `json:"destination_id"`
+	Tags        []string `json:"tags"`
+	ExternalID  string   `json:"external_id"`
+}
+
+type transactionSplitResponse struct {
+	Data struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			Transactions []TransactionSplit `json:"transactions"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// GetTransaction returns the first split of a transaction group, or nil if
+// the group doesn't exist (any more)
+func (c *Client) GetTransaction(groupID string) (*TransactionSplit, error) {
+	req, err := c.newRequest("GET", "/transactions/"+groupID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
 	if resp.StatusCode > 299 {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("create transaction failed: %s - %s", resp.Status, string(body))
+		return nil, fmt.Errorf("get transaction failed: %s - %s", resp.Status, string(body))
 	}
 
+	var group transactionSplitResponse
+	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+		return nil, err
+	}
+	if len(group.Data.Attributes.Transactions) == 0 {
+		return nil, fmt.Errorf("transaction %s has no splits", groupID)
+	}
+	return &group.Data.Attributes.Transactions[0], nil
+}
+
+// TransactionGroup is a transaction as listed by Firefly, with its splits
+type TransactionGroup struct {
+	ID     string
+	Splits []TransactionSplit
+}
+
+type transactionListResponse struct {
+	Data []struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			Transactions []TransactionSplit `json:"transactions"`
+		} `json:"attributes"`
+	} `json:"data"`
+	Meta Meta `json:"meta"`
+}
+
+// GetAccountTransactions returns the transactions of an account between
+// two dates (inclusive), following pagination
+func (c *Client) GetAccountTransactions(accountID, start, end string) ([]TransactionGroup, error) {
+	var all []TransactionGroup
+
+	for page := 1; ; page++ {
+		path := fmt.Sprintf("/accounts/%s/transactions?start=%s&end=%s&page=%d&limit=100", accountID, start, end, page)
+		req, err := c.newRequest("GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode > 299 {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("firefly get account transactions failed: %s - %s", resp.Status, string(body))
+		}
+
+		var list transactionListResponse
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, g := range list.Data {
+			all = append(all, TransactionGroup{ID: g.ID, Splits: g.Attributes.Transactions})
+		}
+
+		if len(list.Data) == 0 || page >= list.Meta.Pagination.TotalPages {
+			break
+		}
+	}
+
+	return all, nil
+}
+
+// TransactionUpdate holds the fields of a split to change, empty fields are
+// left as they are
+type TransactionUpdate struct {
+	JournalID   string `json:"transaction_journal_id,omitempty"`
+	Description string `json:"description,omitempty"`
+	Amount      string `json:"amount,omitempty"`
+	Date        string `json:"date,omitempty"`
+	Reconciled  bool   `json:"reconciled,omitempty"`
+	// Tags replaces the transaction's tags when set
+	Tags []string `json:"tags,omitempty"`
+	// ExternalID is changed when set, to "" clears it
+	ExternalID *string `json:"external_id,omitempty"`
+}
+
+type transactionUpdatePayload struct {
+	ApplyRules   bool                `json:"apply_rules"`
+	Transactions []TransactionUpdate `json:"transactions"`
+}
+
+// UpdateTransaction changes a single split transaction without running
+// rules over it again
+func (c *Client) UpdateTransaction(groupID string, update TransactionUpdate) error {
+	payload := transactionUpdatePayload{Transactions: []TransactionUpdate{update}}
+
+	req, err := c.newRequest("PUT", "/transactions/"+groupID, payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("update transaction failed: %s - %s", resp.Status, string(body))
+	}
 	return nil
 }
+
+// MarkReconciled sets the reconciled flag of a transaction
+func (c *Client) MarkReconciled(groupID, journalID string) error {
+	return c.UpdateTransaction(groupID, TransactionUpdate{JournalID: journalID, Reconciled: true})
+}
@@ -0,0 +1,240 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week).
+type Schedule struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// Standard cron semantics: if both day fields are restricted, a day
+	// matches when either of them matches.
+	domStar bool
+	dowStar bool
+}
+
+type field struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{min: 0, max: 59}
+	hourField   = field{min: 0, max: 23}
+	domField    = field{min: 1, max: 31}
+	monthField  = field{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = field{min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression such as "0 6 * * *" or "@daily".
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	spec := expr
+	if d, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &Schedule{expr: expr}
+	var err error
+	if s.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, fmt.Errorf("invalid minute in %q: %w", expr, err)
+	}
+	if s.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, fmt.Errorf("invalid hour in %q: %w", expr, err)
+	}
+	if s.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, fmt.Errorf("invalid day of month in %q: %w", expr, err)
+	}
+	if s.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, fmt.Errorf("invalid month in %q: %w", expr, err)
+	}
+	if s.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, fmt.Errorf("invalid day of week in %q: %w", expr, err)
+	}
+	// 7 is an alias for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	// Like cron, "*/2" counts as unrestricted as well
+	s.domStar = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[2], "?")
+	s.dowStar = strings.HasPrefix(fields[4], "*") || strings.HasPrefix(fields[4], "?")
+
+	return s, nil
+}
+
+// String returns the expression the schedule was parsed from.
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+func parseField(value string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		b, err := parseRange(part, f)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+func parseRange(part string, f field) (uint64, error) {
+	step := 1
+	if i := strings.Index(part, "/"); i >= 0 {
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("bad step %q", part)
+		}
+		step = n
+		part = part[:i]
+	}
+
+	lo, hi := f.min, f.max
+	switch {
+	case part == "*" || part == "?":
+	case strings.Contains(part, "-"):
+		bounds := strings.SplitN(part, "-", 2)
+		var err error
+		if lo, err = parseValue(bounds[0], f); err != nil {
+			return 0, err
+		}
+		if hi, err = parseValue(bounds[1], f); err != nil {
+			return 0, err
+		}
+	default:
+		v, err := parseValue(part, f)
+		if err != nil {
+			return 0, err
+		}
+		lo = v
+		// "5/10" means starting at 5, every 10
+		if step == 1 {
+			hi = v
+		}
+	}
+
+	if lo > hi {
+		return 0, fmt.Errorf("bad range %q", part)
+	}
+
+	var bits uint64
+	for v := lo; v <= hi; v += step {
+		bits |= 1 << uint(v)
+	}
+	return bits, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range [%d-%d]", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Next returns the first activation time strictly after t, in t's location.
+// A zero time is returned if no activation exists within five years
+// (e.g. "0 0 30 2 *").
+//
+// Days are walked by the wall clock. A time skipped when the clocks go
+// forward runs right after the change, a time that happens twice when they
+// go back runs once.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	y, m, d := t.Date()
+	for i := 0; i <= 5*366; i++ {
+		day := time.Date(y, m, d+i, 12, 0, 0, 0, loc)
+		if s.month&(1<<uint(day.Month())) == 0 || !s.dayMatches(day) {
+			continue
+		}
+		var next time.Time
+		for hour := 0; hour < 24; hour++ {
+			if s.hour&(1<<uint(hour)) == 0 {
+				continue
+			}
+			for minute := 0; minute < 60; minute++ {
+				if s.minute&(1<<uint(minute)) == 0 {
+					continue
+				}
+				at := wallTime(day, hour, minute)
+				if !at.After(t) || (!next.IsZero() && !at.Before(next)) {
+					continue
+				}
+				next = at
+				// Later times of the day only come later, unless this one
+				// was moved by a clock change
+				if at.Hour() == hour && at.Minute() == minute {
+					return next
+				}
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// wallTime returns when the clock on day shows hour:minute. A time the
+// clocks skip is moved forward by as much as they skip, a time they show
+// twice is the first of the two. time.Date makes no promise for either.
+func wallTime(day time.Time, hour, minute int) time.Time {
+	loc := day.Location()
+	at := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc)
+	// Read with the offset in effect before any change that day
+	_, before := at.Add(-12 * time.Hour).Zone()
+	first := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, time.UTC).
+		Add(-time.Duration(before) * time.Second).In(loc)
+	switch {
+	case first.Hour() == hour && first.Minute() == minute:
+		return first
+	case at.Hour() == hour && at.Minute() == minute:
+		return at
+	}
+	return first
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
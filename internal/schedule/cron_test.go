@@ -0,0 +1,115 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	// The DST tests don't depend on the zones installed
+	_ "time/tzdata"
+)
+
+func TestParse(t *testing.T) {
+	for _, expr := range []string{"0 6 * * *", "@daily", "@HOURLY", "*/15 9-17 * * mon-fri", "0 0 1,15 * *", "5/10 * * jan-mar 7", "0 0 ? * sun"} {
+		if _, err := Parse(expr); err != nil {
+			t.Errorf("Parse(%q): %v", expr, err)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"5-1 * * * *", "*/0 * * * *", "*/x * * * *", "foo * * * *", "@bogus"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		expr, from, want string
+	}{
+		{"0 6 * * *", "2024-03-01 05:00", "2024-03-01 06:00"},
+		// Strictly after, even within the minute
+		{"0 6 * * *", "2024-03-01 06:00", "2024-03-02 06:00"},
+		{"@hourly", "2024-03-01 05:59", "2024-03-01 06:00"},
+		{"*/15 * * * *", "2024-03-01 05:16", "2024-03-01 05:30"},
+		{"0 0 1 1 *", "2024-03-01 00:00", "2025-01-01 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		// 7 is Sunday as well, 2024-03-03 is a Sunday
+		{"0 9 * * 7", "2024-03-01 00:00", "2024-03-03 09:00"},
+		// Both day fields restricted: the 13th or a Friday
+		{"0 0 13 * 5", "2024-03-09 00:00", "2024-03-13 00:00"},
+		{"0 0 13 * 5", "2024-03-13 00:00", "2024-03-15 00:00"},
+		// A day field starting with * is unrestricted: odd days that are
+		// also a Monday, 2024-03-11 is a Monday on an odd day
+		{"0 0 */2 * mon", "2024-03-01 00:00", "2024-03-11 00:00"},
+		// The 1st of a month that is a Sunday, Tuesday, Thursday or Saturday
+		{"0 0 1 * */2", "2024-03-02 00:00", "2024-06-01 00:00"},
+	} {
+		s, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.expr, err)
+		}
+		if got := s.Next(utc(tc.from)); !got.Equal(utc(tc.want)) {
+			t.Errorf("%q after %s = %s, want %s", tc.expr, tc.from, got.Format("2006-01-02 15:04"), tc.want)
+		}
+	}
+
+	s, _ := Parse("0 0 30 2 *")
+	if got := s.Next(utc("2024-03-01 00:00")); !got.IsZero() {
+		t.Errorf("0 0 30 2 * = %s, want none", got)
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	for _, tc := range []struct {
+		zone, expr, from string
+		// want are the runs in UTC
+		want []string
+	}{
+		// Sydney skips 02:00-03:00 on 2024-10-06, the run happens right
+		// after at 03:30 AEDT
+		{"Australia/Sydney", "30 2 * * *", "2024-10-04 12:00",
+			[]string{"2024-10-04 16:30", "2024-10-05 16:30", "2024-10-06 15:30"}},
+		// and repeats 02:00-03:00 on 2024-04-07, the run happens once, at
+		// the first 02:30 AEDT
+		{"Australia/Sydney", "30 2 * * *", "2024-04-05 12:00",
+			[]string{"2024-04-05 15:30", "2024-04-06 15:30", "2024-04-07 16:30"}},
+		{"Australia/Sydney", "0 6 * * *", "2024-10-05 12:00",
+			[]string{"2024-10-05 19:00", "2024-10-06 19:00"}},
+		// New York skips 02:00-03:00 on 2024-03-10, the run is at 03:30 EDT
+		{"America/New_York", "30 2 * * *", "2024-03-09 00:00",
+			[]string{"2024-03-09 07:30", "2024-03-10 07:30", "2024-03-11 06:30"}},
+		// and repeats 01:00-02:00 on 2024-11-03
+		{"America/New_York", "30 1 * * *", "2024-11-02 00:00",
+			[]string{"2024-11-02 05:30", "2024-11-03 05:30", "2024-11-04 06:30"}},
+		// Hourly runs skip the second 01:00
+		{"America/New_York", "0 * * * *", "2024-11-03 04:30",
+			[]string{"2024-11-03 05:00", "2024-11-03 07:00", "2024-11-03 08:00"}},
+	} {
+		loc, err := time.LoadLocation(tc.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.expr, err)
+		}
+		from, _ := time.Parse("2006-01-02 15:04", tc.from)
+		at := from.In(loc)
+		for _, want := range tc.want {
+			at = s.Next(at)
+			if got := at.UTC().Format("2006-01-02 15:04"); got != want {
+				t.Errorf("%s %q: got %s (%s), want %s", tc.zone, tc.expr, got, at.Format("2006-01-02 15:04 MST"), want)
+				break
+			}
+			if at.Location() != loc {
+				t.Errorf("%s %q: %s is not in %s", tc.zone, tc.expr, at, tc.zone)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"fidi/internal/basiq"
+	"fidi/internal/firefly"
+	"fidi/internal/storage"
+)
+
+// suggestedKind picks the kind of Firefly account to create for a Basiq account
+func suggestedKind(b basiq.Account) string {
+	switch strings.ToLower(b.Class.Type) {
+	case "credit-card":
+		return kindCreditCard
+	case "mortgage", "loan":
+		return kindLiability
+	}
+	return kindAsset
+}
+
+// createFireflyAccount creates a Firefly account for a Basiq account and
+// maps the two. The opening balance is the Basiq balance minus everything
+// the first sync will import, dated the day the sync starts from, so that
+// the Firefly balance matches the bank once the sync has run. The sync
+// position and the mapping's start date are set to that day, so the first
+// sync imports exactly those transactions, whenever it runs.
+func (s *Server) createFireflyAccount(userID string, b basiq.Account, kind string) (*storage.AccountMapping, error) {
+	balance, err := strconv.ParseFloat(b.Balance, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid balance %q for %s", b.Balance, b.Name)
+	}
+
+	bClient := s.basiqClient()
+	since := s.syncSince(storage.AccountMapping{BasiqAccountID: b.ID})
+	sinceDay, err := time.Parse("2006-01-02", since[:min(len(since), 10)])
+	if err != nil {
+		return nil, fmt.Errorf("invalid sync position %q for %s", since, b.Name)
+	}
+	txs, err := bClient.GetTransactionsRange(userID, b.ID, since, "")
+	if err != nil {
+		return nil, fmt.Errorf("fetching transactions: %w", err)
+	}
+	toImport := 0.0
+	for _, tx := range txs {
+		amount, _ := strconv.ParseFloat(tx.Amount, 64)
+		toImport += amount
+	}
+	opening := balance - toImport
+
+	notes := "Created by the Basiq importer."
+	if b.Institution != "" {
+		institution := b.Institution
+		if inst, err := bClient.GetInstitution(b.Institution); err == nil {
+			institution = inst.Name
+		} else {
+			log.Printf("Failed to look up institution %s: %v", b.Institution, err)
+		}
+		notes += " Institution: " + institution
+	}
+
+	req := firefly.AccountRequest{
+		Name:               b.Name,
+		CurrencyCode:       b.Currency,
+		AccountNumber:      b.AccountNo,
+		OpeningBalance:     fmt.Sprintf("%.2f", opening),
+		OpeningBalanceDate: since[:10],
+		Notes:              notes,
+		Active:             true,
+	}
+
+	switch kind {
+	case kindCreditCard:
+		req.Type = firefly.AccountTypeAsset
+		req.AccountRole = firefly.RoleCreditCard
+		req.CreditCardType = "monthlyFull"
+		req.MonthlyPaymentDate = time.Now().Format("2006-01-02")
+	case kindLiability:
+		req.Type = "liability"
+		req.LiabilityType = "loan"
+		if strings.ToLower(b.Class.Type) == "mortgage" {
+			req.LiabilityType = "mortgage"
+		}
+		// Basiq reports debt as a negative balance, Firefly wants the amount owed
+		req.LiabilityDirection = "debit"
+		req.OpeningBalance = fmt.Sprintf("%.2f", math.Abs(opening))
+		req.Interest = "0"
+		req.InterestPeriod = "monthly"
+	default:
+		kind = kindAsset
+		req.Type = firefly.AccountTypeAsset
+		req.AccountRole = "defaultAsset"
+		if t := strings.ToLower(b.Class.Type); t == "savings" || t == "term-deposit" {
+			req.AccountRole = "savingAsset"
+		}
+	}
+
+	created, err := s.fireflyClient().CreateAccount(req)
+	if err != nil {
+		return nil, err
+	}
+
+	m := storage.AccountMapping{
+		BasiqAccountID:     b.ID,
+		FireflyAccountID:   created.ID,
+		AccountName:        b.Name,
+		FireflyAccountKind: kind,
+		// Anything older is in the opening balance, the overlap with
+		// earlier days mustn't import it again
+		StartDate: sinceDay.AddDate(0, 0, 1).Format("2006-01-02"),
+	}
+	err = s.db.InTx(func(tx storage.Store) error {
+		if err := tx.SaveMapping(m); err != nil {
+			return err
+		}
+		return tx.SetKV("last_sync_"+b.ID, since)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("account %s created in Firefly but mapping failed: %w", created.ID, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"fidi/internal/basiq"
+	"fidi/internal/firefly"
+	"fidi/internal/storage"
+)
+
+// checkBalances compares the Basiq and Firefly balances of the synced
+// accounts and stores the result with the run and as the account's latest
+// check. Accounts that failed to sync are left alone, their drift is expected.
+func (s *Server) checkBalances(ctx context.Context, bClient *basiq.Client, fClient *firefly.Client, userID string, runID int64, mappings []storage.AccountMapping, results []storage.SyncRunAccount, errs []error) {
+	if err := s.basiqLimit.acquire(ctx); err != nil {
+		return
+	}
+	bAccounts, err := bClient.GetAccounts(userID)
+	s.basiqLimit.release()
+	if err != nil {
+		log.Printf("Skipping balance checks, failed to get Basiq accounts: %v", err)
+		return
+	}
+	byID := make(map[string]basiq.Account)
+	for _, a := range bAccounts {
+		byID[a.ID] = a
+	}
+
+	for i, m := range mappings {
+		b, ok := byID[m.BasiqAccountID]
+		if !ok || errs[i] != nil || results[i].BasiqAccountID == "" {
+			continue
+		}
+		if err := s.fireflyLimit.acquire(ctx); err != nil {
+			return
+		}
+		check, err := s.checkBalance(fClient, m, b)
+		s.fireflyLimit.release()
+		if err != nil {
+			log.Printf("Balance check for %s failed: %v", m.BasiqAccountID, err)
+			continue
+		}
+
+		results[i].BasiqBalance = check.BasiqBalance
+		results[i].FireflyBalance = check.FireflyBalance
+		results[i].Drift = check.Drift
+		if check.HasDrift() {
+			log.Printf("Balance of %s is off by %s (Basiq %s, Firefly %s)", m.AccountName, check.Drift, check.BasiqBalance, check.FireflyBalance)
+		}
+		s.events.publish(SyncEvent{Type: EventBalanceChecked, RunID: runID, AccountID: m.BasiqAccountID, AccountName: m.AccountName,
+			Amount: check.Drift})
+	}
+}
+
+// checkBalance compares one account and stores the result. Both balances
+// use the asset sign convention, negative means money is owed, so liabilities
+// are compared by the amount owed whatever sign Firefly reports it with.
+func (s *Server) checkBalance(fClient *firefly.Client, m storage.AccountMapping, b basiq.Account) (storage.BalanceCheck, error) {
+	bBalance, err := strconv.ParseFloat(b.Balance, 64)
+	if err != nil {
+		return storage.BalanceCheck{}, fmt.Errorf("invalid Basiq balance %q", b.Balance)
+	}
+	if m.InvertSign {
+		bBalance = -bBalance
+	}
+
+	account, err := fClient.GetAccount(m.FireflyAccountID)
+	if err != nil {
+		return storage.BalanceCheck{}, err
+	}
+	fBalance, err := strconv.ParseFloat(account.Attributes.CurrentBalance, 64)
+	if err != nil {
+		return storage.BalanceCheck{}, fmt.Errorf("invalid Firefly balance %q", account.Attributes.CurrentBalance)
+	}
+
+	if m.FireflyAccountKind == kindLiability {
+		bBalance, fBalance = -math.Abs(bBalance), -math.Abs(fBalance)
+	}
+
+	check := storage.BalanceCheck{
+		BasiqAccountID: m.BasiqAccountID,
+		BasiqBalance:   fmt.Sprintf("%.2f", bBalance),
+		FireflyBalance: fmt.Sprintf("%.2f", fBalance),
+		Drift:          fmt.Sprintf("%.2f", bBalance-fBalance),
+	}
+	return check, s.db.SaveBalanceCheck(check)
+}
+
+// recheckBalance fetches both balances again and stores the comparison
+func (s *Server) recheckBalance(userID string, m storage.AccountMapping) (storage.BalanceCheck, error) {
+	bAccounts, err := s.basiqClient().GetAccounts(userID)
+	if err != nil {
+		return storage.BalanceCheck{}, err
+	}
+	for _, b := range bAccounts {
+		if b.ID == m.BasiqAccountID {
+			return s.checkBalance(s.fireflyClient(), m, b)
+		}
+	}
+	return storage.BalanceCheck{}, fmt.Errorf("account %s not found at Basiq", m.BasiqAccountID)
+}
+
+// reconcileBalance books the difference between the Basiq and Firefly
+// balance in Firefly. Asset accounts and credit cards get a reconciliation
+// transaction; Firefly doesn't reconcile liabilities, so they get a
+// withdrawal or deposit instead.
+func (s *Server) reconcileBalance(userID string, m storage.AccountMapping) (storage.BalanceCheck, error) {
+	check, err := s.recheckBalance(userID, m)
+	if err != nil || !check.HasDrift() {
+		return check, err
+	}
+
+	drift, _ := strconv.ParseFloat(check.Drift, 64)
+	ffTx := firefly.Transaction{
+		Description: "Balance reconciliation with Basiq",
+		Date:        time.Now().Format("2006-01-02"),
+		Amount:      fmt.Sprintf("%.2f", math.Abs(drift)),
+		Tags:        m.TagList(),
+	}
+	switch {
+	case m.FireflyAccountKind == kindLiability && drift > 0:
+		ffTx.Type = "deposit"
+		ffTx.SourceName = "Balance adjustment"
+		ffTx.DestinationID = m.FireflyAccountID
+	case m.FireflyAccountKind == kindLiability:
+		ffTx.Type = "withdrawal"
+		ffTx.SourceID = m.FireflyAccountID
+		ffTx.DestinationName = "Balance adjustment"
+	case drift > 0:
+		ffTx.Type = "reconciliation"
+		ffTx.DestinationID = m.FireflyAccountID
+		ffTx.Reconciled = true
+	default:
+		ffTx.Type = "reconciliation"
+		ffTx.SourceID = m.FireflyAccountID
+		ffTx.Reconciled = true
+	}
+
+	if _, err := s.fireflyClient().CreateTransaction(ffTx); err != nil {
+		return check, fmt.Errorf("creating reconciliation: %w", err)
+	}
+	log.Printf("Reconciled %s: booked %s %s", m.AccountName, ffTx.Type, ffTx.Amount)
+	return s.recheckBalance(userID, m)
+}
+
+// markReconciled flags the account's imported transactions as reconciled in
+// Firefly. Only done while the balances agree.
+func (s *Server) markReconciled(userID string, m storage.AccountMapping) (int, error) {
+	check, err := s.recheckBalance(userID, m)
+	if err != nil {
+		return 0, err
+	}
+	if check.HasDrift() {
+		return 0, fmt.Errorf("balances differ by %s, reconcile them first", check.Drift)
+	}
+
+	imported, err := s.db.GetUnreconciledImports(m.BasiqAccountID)
+	if err != nil {
+		return 0, err
+	}
+	fClient := s.fireflyClient()
+	marked := 0
+	for _, t := range imported {
+		if err := fClient.MarkReconciled(t.FireflyGroupID, t.FireflyJournalID); err != nil {
+			return marked, err
+		}
+		if err := s.db.SetImportedReconciled(t.BasiqTransactionID); err != nil {
+			return marked, err
+		}
+		marked++
+	}
+	return marked, nil
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"fidi/internal/basiq"
+	"fidi/internal/firefly"
+	"fidi/internal/storage"
+)
+
+// changesReview holds changed transactions for approval instead of
+// updating Firefly straight away
+const changesReview = "review"
+
+var (
+	// errUnchanged marks a transaction that was imported before and hasn't
+	// changed at the bank since
+	errUnchanged = errors.New("already imported")
+	// errChangeFlagged marks a changed transaction held for review
+	errChangeFlagged = errors.New("changed at the bank, waiting for review")
+)
+
+// transactionHash fingerprints the parts of a Basiq transaction that end
+// up in Firefly
+func transactionHash(tx basiq.Transaction) string {
+	if tx.PostDate == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{tx.Description, tx.Amount, tx.PostDate}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// overlapSince moves the sync start back by the overlap window, so recent
+// transactions are looked at again. It never goes past the mapping's start date.
+func (s *Server) overlapSince(m storage.AccountMapping, since string) string {
+	t, err := time.Parse("2006-01-02", since[:min(len(since), 10)])
+	if err != nil {
+		return since
+	}
+	overlap := t.AddDate(0, 0, -s.config().OverlapDays).Format("2006-01-02")
+	if start, err := dayBefore(m.StartDate); err == nil && start > overlap {
+		overlap = start
+	}
+	return overlap
+}
+
+// reviseTransaction deals with a Basiq transaction we imported before. If
+// it changed at the bank since, the Firefly transaction is updated, or the
+// change is held for review.
+func (s *Server) reviseTransaction(fClient *firefly.Client, tx basiq.Transaction, ffTx firefly.Transaction, imp *storage.ImportedTransaction) error {
+	if imp.State == storage.ImportDeleted {
+		// Removed from Firefly on purpose
+		return errUnchanged
+	}
+	hash := transactionHash(tx)
+	payload, err := json.Marshal(ffTx)
+	if err != nil {
+		return err
+	}
+
+	// Imported before fingerprints were kept, take it as it is now
+	if imp.PayloadHash == "" || imp.FireflyPayload == "" {
+		if err := s.db.UpdateImportedPayload(tx.ID, hash, string(payload), ffTx.Date, ffTx.Amount); err != nil {
+			return err
+		}
+		return errUnchanged
+	}
+	if hash == imp.PayloadHash {
+		return errUnchanged
+	}
+	if hash == imp.PendingHash {
+		return errChangeFlagged
+	}
+
+	if s.config().ChangedTransactions == changesReview {
+		log.Printf("Transaction %s changed at the bank, holding for review", tx.ID)
+		if err := s.db.SetPendingChange(tx.ID, hash, string(payload)); err != nil {
+			return err
+		}
+		return errChangeFlagged
+	}
+	return s.applyChange(fClient, imp, tx.ID, hash, ffTx)
+}
+
+// applyChange updates the Firefly transaction to match the bank. Fields
+// the user edited in Firefly since we last wrote them are left alone.
+func (s *Server) applyChange(fClient *firefly.Client, imp *storage.ImportedTransaction, basiqTxID, hash string, ffTx firefly.Transaction) error {
+	var sent firefly.Transaction
+	if err := json.Unmarshal([]byte(imp.FireflyPayload), &sent); err != nil {
+		return fmt.Errorf("invalid stored payload: %w", err)
+	}
+	payload, err := json.Marshal(ffTx)
+	if err != nil {
+		return err
+	}
+	record := func() error {
+		return s.db.UpdateImportedPayload(basiqTxID, hash, string(payload), ffTx.Date, ffTx.Amount)
+	}
+
+	current, err := fClient.GetTransaction(imp.FireflyGroupID)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		// Deleted in Firefly on purpose, don't bring it back
+		log.Printf("Transaction %s changed at the bank but was deleted from Firefly, leaving it", basiqTxID)
+		if err := record(); err != nil {
+			return err
+		}
+		return errUnchanged
+	}
+
+	if ffTx.Type != sent.Type {
+		// The sign flipped, that is a different transaction altogether
+		log.Printf("Transaction %s changed direction at the bank, holding for review", basiqTxID)
+		if err := s.db.SetPendingChange(basiqTxID, hash, string(payload)); err != nil {
+			return err
+		}
+		return errChangeFlagged
+	}
+
+	update := firefly.TransactionUpdate{JournalID: imp.FireflyJournalID}
+	if ffTx.Description != sent.Description && current.Description == sent.Description {
+		update.Description = ffTx.Description
+	}
+	if ffTx.Amount != sent.Amount && sameAmount(current.Amount, sent.Amount) {
+		update.Amount = ffTx.Amount
+	}
+	if ffTx.Date != sent.Date && sameDate(current.Date, sent.Date) {
+		update.Date = ffTx.Date
+	}
+
+	if update.Description != "" || update.Amount != "" || update.Date != "" {
+		if err := fClient.UpdateTransaction(imp.FireflyGroupID, update); err != nil {
+			return err
+		}
+		log.Printf("Updated transaction %s in Firefly to match the bank", basiqTxID)
+	}
+	return record()
+}
+
+// sameAmount compares amounts regardless of formatting, Firefly returns
+// them with many decimals
+func sameAmount(a, b string) bool {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return fmt.Sprintf("%.2f", x) == fmt.Sprintf("%.2f", y)
+}
+
+// sameDate compares the day part of two dates, Firefly adds a time and zone
+func sameDate(a, b string) bool {
+	return a[:min(len(a), 10)] == b[:min(len(b), 10)]
+}
+
+// acceptChange applies a change held for review. Changes of direction
+// can't be made in place, the Firefly transaction is replaced instead.
+func (s *Server) acceptChange(imp *storage.ImportedTransaction) error {
+	var ffTx, sent firefly.Transaction
+	if err := json.Unmarshal([]byte(imp.PendingPayload), &ffTx); err != nil {
+		return fmt.Errorf("invalid pending payload: %w", err)
+	}
+	if err := json.Unmarshal([]byte(imp.FireflyPayload), &sent); err != nil {
+		return fmt.Errorf("invalid stored payload: %w", err)
+	}
+	fClient := s.fireflyClient()
+
+	if ffTx.Type == sent.Type {
+		err := s.applyChange(fClient, imp, imp.BasiqTransactionID, imp.PendingHash, ffTx)
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		return err
+	}
+
+	current, err := fClient.GetTransaction(imp.FireflyGroupID)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		// Deleted in Firefly on purpose, don't bring it back
+		return s.db.UpdateImportedPayload(imp.BasiqTransactionID, imp.PendingHash, imp.PendingPayload, ffTx.Date, ffTx.Amount)
+	}
+	// Keep the tags added in Firefly since
+	for _, tag := range current.Tags {
+		if !slices.Contains(ffTx.Tags, tag) {
+			ffTx.Tags = append(ffTx.Tags, tag)
+		}
+	}
+
+	// The replacement is created before the original goes, so a failure
+	// leaves the transaction in Firefly at least once
+	created, err := fClient.CreateTransaction(ffTx)
+	if err != nil {
+		return err
+	}
+	err = s.db.InTx(func(db storage.Store) error {
+		err := db.SaveImported(storage.ImportedTransaction{
+			BasiqTransactionID: imp.BasiqTransactionID,
+			BasiqAccountID:     imp.BasiqAccountID,
+			FireflyGroupID:     created.GroupID,
+			FireflyJournalID:   created.JournalID,
+			PostDate:           ffTx.Date,
+			Amount:             ffTx.Amount,
+			RunID:              imp.RunID,
+			PayloadHash:        imp.PendingHash,
+			FireflyPayload:     imp.PendingPayload,
+		})
+		if err != nil {
+			return err
+		}
+		// SaveImported leaves the pending change in place
+		if err := db.UpdateImportedPayload(imp.BasiqTransactionID, imp.PendingHash, imp.PendingPayload, ffTx.Date, ffTx.Amount); err != nil {
+			return err
+		}
+		// A repayment keeps its leg, and whoever claimed it, only while it
+		// is still a transfer
+		if ffTx.Type == "transfer" {
+			return db.SaveRepaymentLeg(ffTx.SourceID, ffTx.Amount, ffTx.Date, imp.BasiqTransactionID)
+		}
+		return db.DeleteRepaymentLeg(imp.BasiqTransactionID)
+	})
+	if err != nil {
+		if delErr := fClient.DeleteTransaction(created.GroupID); delErr != nil {
+			log.Printf("Failed to remove replacement transaction %s from Firefly: %v", created.GroupID, delErr)
+		}
+		return err
+	}
+	if err := fClient.DeleteTransaction(imp.FireflyGroupID); err != nil {
+		return fmt.Errorf("replaced, but the original transaction %s is still in Firefly: %w", imp.FireflyGroupID, err)
+	}
+	return nil
+}
+
+// pendingChange is a held change as shown on the review page
+type pendingChange struct {
+	storage.ImportedTransaction
+	AccountName string
+	Sent        firefly.Transaction
+	Changed     firefly.Transaction
+}
+
+// pendingChanges loads the changes waiting for review
+func (s *Server) pendingChanges() ([]pendingChange, error) {
+	imported, err := s.db.GetPendingChanges()
+	if err != nil {
+		return nil, err
+	}
+	names, err := s.accountNames()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]pendingChange, 0, len(imported))
+	for _, imp := range imported {
+		c := pendingChange{ImportedTransaction: imp, AccountName: names[imp.BasiqAccountID]}
+		json.Unmarshal([]byte(imp.FireflyPayload), &c.Sent)
+		json.Unmarshal([]byte(imp.PendingPayload), &c.Changed)
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// accountNames maps Basiq account IDs to the names of their mappings
+func (s *Server) accountNames() (map[string]string, error) {
+	mappings, err := s.db.GetMappings()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, m := range mappings {
+		names[m.BasiqAccountID] = m.AccountName
+	}
+	return names, nil
+}
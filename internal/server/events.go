@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"fidi/internal/storage"
+)
+
+// Sync event types
+const (
+	EventRunStarted          = "run_started"
+	EventAccountStarted      = "account_started"
+	EventPageFetched         = "page_fetched"
+	EventTransactionImported = "transaction_imported"
+	EventTransactionSkipped  = "transaction_skipped"
+	EventTransactionFailed   = "transaction_failed"
+	EventAccountFinished     = "account_finished"
+	EventBalanceChecked      = "balance_checked"
+	EventRunFinished         = "run_finished"
+)
+
+// SyncEvent is a progress notification from a running sync, streamed to
+// the dashboard and to anyone else listening on /events
+type SyncEvent struct {
+	ID            int64     `json:"id"`
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	RunID         int64     `json:"run_id,omitempty"`
+	AccountID     string    `json:"account_id,omitempty"`
+	AccountName   string    `json:"account_name,omitempty"`
+	TransactionID string    `json:"transaction_id,omitempty"`
+	Description   string    `json:"description,omitempty"`
+	Amount        string    `json:"amount,omitempty"`
+	Date          string    `json:"date,omitempty"`
+	Page          int       `json:"page,omitempty"`
+	Count         int       `json:"count,omitempty"`
+	Imported      int       `json:"imported,omitempty"`
+	Skipped       int       `json:"skipped,omitempty"`
+	Failed        int       `json:"failed,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// recentEvents is how many events are kept for clients that reconnect
+const recentEvents = 500
+
+// eventHub fans sync events out to subscribers
+type eventHub struct {
+	mu     sync.Mutex
+	nextID int64
+	recent []SyncEvent
+	subs   map[chan SyncEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan SyncEvent]struct{})}
+}
+
+// publish stamps the event and delivers it to every subscriber. Slow
+// subscribers miss events rather than holding up the sync.
+func (h *eventHub) publish(e SyncEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	e.ID = h.nextID
+	e.Time = time.Now()
+
+	h.recent = append(h.recent, e)
+	if len(h.recent) > recentEvents {
+		h.recent = h.recent[len(h.recent)-recentEvents:]
+	}
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of new events and, if replay is set, the
+// buffered events newer than lastID
+func (h *eventHub) subscribe(lastID int64, replay bool) (chan SyncEvent, []SyncEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan SyncEvent, 256)
+	h.subs[ch] = struct{}{}
+
+	var backlog []SyncEvent
+	if replay {
+		for _, e := range h.recent {
+			if e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	return ch, backlog
+}
+
+func (h *eventHub) unsubscribe(ch chan SyncEvent) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// describe renders an event as a single line of HTML for the dashboard
+func (e SyncEvent) describe() string {
+	account := e.AccountName
+	if account == "" {
+		account = e.AccountID
+	}
+	account = html.EscapeString(account)
+
+	var text, class string
+	switch e.Type {
+	case EventRunStarted:
+		text, class = fmt.Sprintf("Sync run #%d started for %d accounts", e.RunID, e.Count), "text-blue-600 font-bold"
+	case EventAccountStarted:
+		text, class = fmt.Sprintf("%s: syncing", account), "text-blue-600"
+	case EventPageFetched:
+		text, class = fmt.Sprintf("%s: fetched page %d (%d transactions)", account, e.Page, e.Count), "text-gray-600"
+	case EventTransactionImported:
+		text, class = fmt.Sprintf("%s: imported %s %s %s", account, html.EscapeString(e.Date), html.EscapeString(e.Description), html.EscapeString(e.Amount)), "text-green-600"
+	case EventTransactionSkipped:
+		text, class = fmt.Sprintf("%s: skipped %s %s (already in Firefly)", account, html.EscapeString(e.Date), html.EscapeString(e.Description)), "text-gray-500"
+	case EventTransactionFailed:
+		text, class = fmt.Sprintf("%s: failed %s %s: %s", account, html.EscapeString(e.Date), html.EscapeString(e.Description), html.EscapeString(e.Error)), "text-red-600"
+	case EventAccountFinished:
+		text, class = fmt.Sprintf("%s: done, %d imported, %d skipped, %d failed", account, e.Imported, e.Skipped, e.Failed), "text-blue-600"
+		if e.Error != "" {
+			text, class = fmt.Sprintf("%s: %s", account, html.EscapeString(e.Error)), "text-red-600"
+		}
+	case EventBalanceChecked:
+		text, class = fmt.Sprintf("%s: balance matches", account), "text-green-600"
+		if (storage.BalanceCheck{Drift: e.Amount}).HasDrift() {
+			text, class = fmt.Sprintf("%s: balance is off by %s", account, html.EscapeString(e.Amount)), "text-red-600"
+		}
+	case EventRunFinished:
+		text = fmt.Sprintf("Sync run #%d %s: %d imported, %d skipped, %d failed", e.RunID, html.EscapeString(e.Status), e.Imported, e.Skipped, e.Failed)
+		class = "text-green-600 font-bold"
+		if e.Status != "success" {
+			class = "text-red-600 font-bold"
+		}
+	default:
+		text, class = html.EscapeString(e.Type), "text-gray-600"
+	}
+
+	// SSE data must stay on one line
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r", " "), "\n", " ")
+	return fmt.Sprintf(`<div class="%s"><span class="text-gray-400">%s</span> %s</div>`, class, e.Time.Format("15:04:05"), text)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"fidi/internal/basiq"
+	"fidi/internal/firefly"
+	"fidi/internal/storage"
+)
+
+// maxAutoRetries is how many times a failed transaction is retried by
+// later syncs before it is left for the user to deal with
+const maxAutoRetries = 10
+
+var (
+	// errDeadLettered marks a transaction waiting in the dead-letter table,
+	// it is retried from there and not posted again by the sync
+	errDeadLettered = errors.New("failed before, retried from the Failed page")
+	// errDismissed marks a failed transaction the user dismissed
+	errDismissed = errors.New("dismissed on the Failed page")
+)
+
+// checkDeadLettered tells whether a transaction is left to the dead-letter
+// table: pending there, or dismissed by the user
+func (s *Server) checkDeadLettered(basiqTxID string) error {
+	f, err := s.db.GetFailedTransactionByBasiqID(basiqTxID)
+	if err != nil || f == nil {
+		return err
+	}
+	switch f.Status {
+	case storage.FailedPending:
+		return errDeadLettered
+	case storage.FailedDismissed:
+		return errDismissed
+	}
+	return nil
+}
+
+// deadLetter records a transaction that could not be imported so that it
+// can be retried, edited or dismissed later
+func (s *Server) deadLetter(m storage.AccountMapping, tx basiq.Transaction, ffTx firefly.Transaction, importErr error) error {
+	source, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(ffTx)
+	if err != nil {
+		return err
+	}
+
+	return s.db.SaveFailedTransaction(storage.FailedTransaction{
+		BasiqTransactionID: tx.ID,
+		BasiqAccountID:     m.BasiqAccountID,
+		PostDate:           tx.PostDate,
+		Description:        tx.Description,
+		Amount:             tx.Amount,
+		SourcePayload:      string(source),
+		FireflyPayload:     string(payload),
+		Error:              importErr.Error(),
+	})
+}
+
+// retryDeadLetters retries the account's failed transactions and returns
+// how many were imported and how many are still failing
+func (s *Server) retryDeadLetters(ctx context.Context, fClient *firefly.Client, runID int64, m storage.AccountMapping) (int, int) {
+	failed, err := s.db.GetRetryableTransactions(m.BasiqAccountID, maxAutoRetries)
+	if err != nil {
+		log.Printf("Failed to load failed transactions for %s: %v", m.BasiqAccountID, err)
+		return 0, 0
+	}
+
+	imported, stillFailing := 0, 0
+	for i := range failed {
+		if err := s.fireflyLimit.acquire(ctx); err != nil {
+			break
+		}
+		err := s.retryFailed(fClient, runID, &failed[i])
+		s.fireflyLimit.release()
+		s.events.publish(retryEvent(runID, m, failed[i], err))
+		if err != nil {
+			log.Printf("Retry of transaction %s failed: %v", failed[i].BasiqTransactionID, err)
+			stillFailing++
+			continue
+		}
+		imported++
+	}
+	return imported, stillFailing
+}
+
+// retryFailed posts the stored (possibly edited) Firefly payload of a
+// failed transaction again and updates its state
+func (s *Server) retryFailed(fClient *firefly.Client, runID int64, f *storage.FailedTransaction) error {
+	var ffTx firefly.Transaction
+	if err := json.Unmarshal([]byte(f.FireflyPayload), &ffTx); err != nil {
+		s.db.RecordFailedAttempt(f.ID, "invalid payload: "+err.Error())
+		return err
+	}
+
+	created, err := fClient.CreateTransaction(ffTx)
+	if err != nil && !errors.Is(err, firefly.ErrDuplicate) {
+		s.db.RecordFailedAttempt(f.ID, err.Error())
+		return err
+	}
+
+	// A duplicate means it made it into Firefly after all
+	if err != nil {
+		return s.db.SetFailedStatus(f.ID, storage.FailedResolved)
+	}
+
+	// The original Basiq transaction fingerprints the import
+	var tx basiq.Transaction
+	json.Unmarshal([]byte(f.SourcePayload), &tx)
+	tx.ID = f.BasiqTransactionID
+	s.tagRun(fClient, runID, ffTx, created)
+	return s.db.InTx(func(db storage.Store) error {
+		if err := recordImported(db, runID, f.BasiqAccountID, tx, ffTx, created); err != nil {
+			return err
+		}
+		if ffTx.Type == "transfer" {
+			if err := db.SaveRepaymentLeg(ffTx.SourceID, ffTx.Amount, ffTx.Date, f.BasiqTransactionID); err != nil {
+				return err
+			}
+		}
+		return db.SetFailedStatus(f.ID, storage.FailedResolved)
+	})
+}
+
+func retryEvent(runID int64, m storage.AccountMapping, f storage.FailedTransaction, err error) SyncEvent {
+	e := SyncEvent{Type: EventTransactionImported, RunID: runID, AccountID: m.BasiqAccountID, AccountName: m.AccountName,
+		TransactionID: f.BasiqTransactionID, Description: f.Description, Amount: f.Amount, Date: f.PostDate}
+	if err != nil {
+		e.Type = EventTransactionFailed
+		e.Error = err.Error()
+	}
+	return e
+}
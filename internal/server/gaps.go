@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"fidi/internal/basiq"
+)
+
+// Kinds of running balance problems
+const (
+	issueGap       = "gap"
+	issueDuplicate = "duplicate"
+)
+
+// balanceIssue is a place where the running balance doesn't add up
+type balanceIssue struct {
+	Kind string
+	// Date and Transaction are where the problem shows
+	Date        string
+	Transaction basiq.Transaction
+	// After is the last transaction that did add up
+	After *basiq.Transaction
+	// Expected is the balance before Transaction according to After,
+	// Found the one implied by Transaction itself
+	Expected string
+	Found    string
+	// Missing is the total of the transactions that would close the gap
+	Missing string
+}
+
+// verifyResult is the outcome of walking an account's running balances
+type verifyResult struct {
+	Checked int
+	// Unchecked transactions have no running balance, e.g. pending ones
+	Unchecked int
+	Issues    []balanceIssue
+}
+
+// cents parses an amount to whole cents so comparisons are exact
+func cents(amount string) (int64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(math.Round(f * 100)), true
+}
+
+func formatCents(c int64) string {
+	return fmt.Sprintf("%.2f", float64(c)/100)
+}
+
+// verifyRunningBalances proves that no transaction is missing between the
+// first and last one: walking them in order, every transaction's balance
+// must be the previous balance plus its amount. Basiq doesn't say in which
+// order same-day transactions happened, so within a day the order that
+// makes the balances chain up is used.
+func verifyRunningBalances(txs []basiq.Transaction) verifyResult {
+	var res verifyResult
+	byDate := make(map[string][]balanceEntry)
+	var dates []string
+	for _, tx := range txs {
+		amount, okAmount := cents(tx.Amount)
+		balance, okBalance := cents(tx.Balance)
+		if !okAmount || !okBalance || tx.Balance == "" || strings.EqualFold(tx.Status, "pending") {
+			res.Unchecked++
+			continue
+		}
+		date := tx.PostDate
+		if len(date) > 10 {
+			date = date[:10]
+		}
+		if _, ok := byDate[date]; !ok {
+			dates = append(dates, date)
+		}
+		byDate[date] = append(byDate[date], balanceEntry{tx, amount, balance})
+	}
+	sort.Strings(dates)
+
+	seen := make(map[string]bool)
+	var prev *balanceEntry
+	for _, date := range dates {
+		remaining := byDate[date]
+		for len(remaining) > 0 {
+			next := -1
+			if prev != nil {
+				for i, e := range remaining {
+					if e.balance-e.amount == prev.balance {
+						next = i
+						break
+					}
+				}
+			}
+
+			if next < 0 {
+				// A repeat of something already walked is a duplicate,
+				// not a gap
+				for i, e := range remaining {
+					if seen[e.tx.ID] || seen[e.key()] {
+						res.Issues = append(res.Issues, balanceIssue{Kind: issueDuplicate, Date: date, Transaction: e.tx, After: &prev.tx})
+						remaining = append(remaining[:i:i], remaining[i+1:]...)
+						next = -2
+						break
+					}
+				}
+				if next == -2 {
+					continue
+				}
+
+				// Start the chain again from the transaction nothing else
+				// in the day leads up to
+				next = chainStart(remaining)
+				if prev != nil {
+					e := remaining[next]
+					res.Issues = append(res.Issues, balanceIssue{
+						Kind:        issueGap,
+						Date:        date,
+						Transaction: e.tx,
+						After:       &prev.tx,
+						Expected:    formatCents(prev.balance),
+						Found:       formatCents(e.balance - e.amount),
+						Missing:     formatCents(e.balance - e.amount - prev.balance),
+					})
+				}
+			}
+
+			e := remaining[next]
+			remaining = append(remaining[:next:next], remaining[next+1:]...)
+			seen[e.tx.ID] = true
+			seen[e.key()] = true
+			res.Checked++
+			prev = &e
+		}
+	}
+	return res
+}
+
+// balanceEntry is a transaction with its amounts in cents
+type balanceEntry struct {
+	tx      basiq.Transaction
+	amount  int64
+	balance int64
+}
+
+// key identifies a transaction that was reported twice under different IDs
+func (e balanceEntry) key() string {
+	return fmt.Sprintf("%s|%d|%d", e.tx.Description, e.amount, e.balance)
+}
+
+// chainStart picks the entry whose opening balance isn't the closing
+// balance of any other entry, i.e. the first of the day
+func chainStart(entries []balanceEntry) int {
+	closing := make(map[int64]bool)
+	for _, e := range entries {
+		closing[e.balance] = true
+	}
+	for i, e := range entries {
+		if !closing[e.balance-e.amount] {
+			return i
+		}
+	}
+	return 0
+}
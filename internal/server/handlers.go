@@ -1,14 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
 	"time"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"fidi/internal/basiq"
+	"fidi/internal/config"
 	"fidi/internal/firefly"
+	"fidi/internal/schedule"
 	"fidi/internal/storage"
 )
 
@@ -23,6 +30,33 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	userID, _ := s.db.GetKV("basiq_user_id")
 	lastRun, _ := s.db.GetKV("last_run")
 	lastRunStatus, _ := s.db.GetKV("last_run_status")
+	nextRun, _ := s.db.GetKV("schedule_next_run")
+	failedCount, _ := s.db.CountFailedTransactions(storage.FailedPending)
+
+	// Latest balance comparison of every mapped account
+	type balance struct {
+		Mapping storage.AccountMapping
+		Check   storage.BalanceCheck
+	}
+	var balances []balance
+	checks, err := s.db.GetBalanceChecks()
+	if err != nil {
+		log.Printf("Failed to load balance checks: %v", err)
+	}
+	mappings, _ := s.db.GetMappings()
+	for _, m := range mappings {
+		if check, ok := checks[m.BasiqAccountID]; ok {
+			balances = append(balances, balance{Mapping: m, Check: check})
+		}
+	}
+
+	legacy, err := s.db.GetLegacyImport()
+	if err != nil {
+		log.Printf("Failed to load legacy import report: %v", err)
+	}
+	if legacy != nil && legacy.Dismissed {
+		legacy = nil
+	}
 
 	data := struct {
 		Year           int
@@ -30,12 +64,26 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 		BasiqUserID    string
 		LastRun        string
 		LastRunStatus  string
+		NextRun        string
+		Schedule       string
+		Timezone       string
+		FailedCount    int
+		Balances       []balance
+		LegacyImport   *storage.LegacyImport
+		SelfTest       *selfTest
 	}{
 		Year:           time.Now().Year(),
 		BasiqConnected: userID != "",
 		BasiqUserID:    userID,
 		LastRun:        lastRun,
 		LastRunStatus:  lastRunStatus,
+		NextRun:        nextRun,
+		Schedule:       s.config().SyncSchedule,
+		Timezone:       s.location().String(),
+		FailedCount:    failedCount,
+		Balances:       balances,
+		LegacyImport:   legacy,
+		SelfTest:       s.lastSelfTestResult(),
 	}
 
 	s.render(w, "dashboard.html", data)
@@ -51,7 +99,7 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		email := r.FormValue("email")
 		mobile := r.FormValue("mobile")
 
-		client := basiq.New(s.cfg.BasiqAPIKey)
+		client := s.basiqClient()
 		user, err := client.CreateUser(email, mobile)
 		if err != nil {
 			http.Error(w, "Failed to create user: "+err.Error(), http.StatusInternalServerError)
@@ -104,74 +152,833 @@ func (s *Server) handleMapping(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "POST" {
-		r.ParseForm()
-		basiqIDs := r.Form["basiq_id[]"]
-		basiqNames := r.Form["basiq_name[]"]
-		fireflyIDs := r.Form["firefly_id[]"]
-
-		for i, bid := range basiqIDs {
-			fid := fireflyIDs[i]
-			if fid != "" {
-				s.db.SaveMapping(storage.AccountMapping{
-					BasiqAccountID:   bid,
-					FireflyAccountID: fid,
-					AccountName:      basiqNames[i],
-				})
-			}
-		}
-		return // HTMX expects no content or just 200
+		s.saveMappings(w, r)
+		return
 	}
 
-	bClient := basiq.New(s.cfg.BasiqAPIKey)
+	// Shown on the page, an empty dropdown alone doesn't say why
+	var loadErrors []string
+	bClient := s.basiqClient()
 	bAccounts, err := bClient.GetAccounts(userID)
 	if err != nil {
 		// If fails (e.g. no consent), might return empty
 		log.Println("Failed to get Basiq accounts:", err)
+		loadErrors = append(loadErrors, "Failed to load the Basiq accounts: "+err.Error())
 		bAccounts = []basiq.Account{}
 	}
 
-	fClient := firefly.New(s.cfg.FireflyURL, s.cfg.FireflyAccessToken)
-	fAccounts, err := fClient.GetAccounts()
+	// Expense and revenue accounts are rarely what you want, so only on request
+	showAll := r.URL.Query().Get("all") == "1"
+	types := []string{firefly.AccountTypeAsset, firefly.AccountTypeLiabilities}
+	if showAll {
+		types = append(types, firefly.AccountTypeExpense, firefly.AccountTypeRevenue)
+	}
+
+	fClient := s.fireflyClient()
+	fAccounts, err := fClient.GetAccounts(types...)
 	if err != nil {
 		log.Println("Failed to get Firefly accounts:", err)
+		loadErrors = append(loadErrors, "Failed to load the Firefly III accounts: "+err.Error())
 		fAccounts = []firefly.Account{}
 	}
 
 	existingMappings, _ := s.db.GetMappings()
 	mappingMap := make(map[string]string)
+	settings := make(map[string]storage.AccountMapping)
 	for _, m := range existingMappings {
 		mappingMap[m.BasiqAccountID] = m.FireflyAccountID
+		settings[m.BasiqAccountID] = m
+	}
+
+	suggestions := suggestMappings(bAccounts, fAccounts, mappingMap)
+
+	suggestedKinds := make(map[string]string)
+	for _, b := range bAccounts {
+		suggestedKinds[b.ID] = suggestedKind(b)
+	}
+
+	// Only plain asset accounts can pay off a card or loan
+	var paymentAccounts []firefly.Account
+	for _, a := range fAccounts {
+		if accountKind(a) == kindAsset && a.Attributes.Type == firefly.AccountTypeAsset {
+			paymentAccounts = append(paymentAccounts, a)
+		}
 	}
 
 	data := struct {
-		Year           int
-		BasiqAccounts  []basiq.Account
+		Year            int
+		BasiqAccounts   []basiq.Account
 		FireflyAccounts []firefly.Account
-		Mappings       map[string]string
+		AccountGroups   []accountGroup
+		ShowAll         bool
+		PaymentAccounts []firefly.Account
+		SuggestedKinds  map[string]string
+		Suggestions     map[string]suggestion
+		Mappings        map[string]string
+		Settings        map[string]storage.AccountMapping
+		DefaultSchedule string
+		Errors          []string
 	}{
 		Year:            time.Now().Year(),
 		BasiqAccounts:   bAccounts,
 		FireflyAccounts: fAccounts,
+		AccountGroups:   groupAccounts(fAccounts),
+		ShowAll:         showAll,
 		Mappings:        mappingMap,
+		PaymentAccounts: paymentAccounts,
+		SuggestedKinds:  suggestedKinds,
+		Suggestions:     suggestions,
+		Settings:        settings,
+		DefaultSchedule: s.config().SyncSchedule,
+		Errors:          loadErrors,
 	}
 
 	s.render(w, "mapping.html", data)
 }
 
+// handleRollbackRun queues the rollback of a sync run
+func (s *Server) handleRollbackRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid run id", http.StatusBadRequest)
+		return
+	}
+	run, err := s.db.GetRun(id)
+	if err != nil {
+		http.Error(w, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if run == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if run.Status == storage.RunRunning || run.Status == storage.RunRolledBack {
+		w.Write([]byte(fmt.Sprintf(`<span class="text-red-600">Run #%d is %s.</span>`, id, run.Status)))
+		return
+	}
+
+	jobID, err := s.enqueueJob(storage.JobRollbackRun, jobPayload{RunID: id}, time.Now())
+	if err != nil {
+		http.Error(w, "Failed to queue rollback: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf(`<span class="text-blue-600">Queued rollback as job #%d.</span>`, jobID)))
+}
+
+// handleAccountHealth checks an account's transactions for gaps and
+// duplicates using Basiq's running balances
+func (s *Server) handleAccountHealth(w http.ResponseWriter, r *http.Request) {
+	mappings, err := s.db.GetMappings()
+	if err != nil {
+		http.Error(w, "Failed to load mappings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days <= 0 {
+		days = 90
+	}
+	if days > 730 {
+		days = 730
+	}
+
+	data := struct {
+		Year     int
+		Mappings []storage.AccountMapping
+		Account  *storage.AccountMapping
+		Days     int
+		Result   *verifyResult
+		Error    string
+		// Truncated says why only part of the transactions were checked
+		Truncated string
+	}{
+		Year:     time.Now().Year(),
+		Mappings: mappings,
+		Days:     days,
+	}
+
+	accountID := r.URL.Query().Get("account")
+	for i := range mappings {
+		if mappings[i].BasiqAccountID == accountID {
+			data.Account = &mappings[i]
+		}
+	}
+
+	if data.Account != nil {
+		userID, err := s.basiqUserID()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		since := time.Now().AddDate(0, 0, -days).Format("2006-01-02")
+		txs, err := s.basiqClient().GetTransactionsRange(userID, accountID, since, "")
+		if errors.Is(err, basiq.ErrTruncated) {
+			data.Truncated = err.Error()
+			err = nil
+		}
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			res := verifyRunningBalances(txs)
+			data.Result = &res
+		}
+	}
+
+	s.render(w, "health.html", data)
+}
+
+// handleReconcile resolves balance drift once the user approves: either by
+// booking the difference, or by marking the imported transactions reconciled
+func (s *Server) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := s.basiqUserID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := s.db.GetMappingByBasiqID(r.FormValue("basiq_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		http.Error(w, "Account not mapped", http.StatusNotFound)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "adjust":
+		check, err := s.reconcileBalance(userID, *m)
+		if err != nil {
+			w.Write([]byte(`<span class="text-red-600">` + template.HTMLEscapeString(err.Error()) + `</span>`))
+			return
+		}
+		if check.HasDrift() {
+			w.Write([]byte(fmt.Sprintf(`<span class="text-yellow-600">Still off by %s, Firefly may not have updated the balance yet.</span>`, template.HTMLEscapeString(check.Drift))))
+			return
+		}
+	case "mark":
+		n, err := s.markReconciled(userID, *m)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf(`<span class="text-red-600">Marked %d, then: %s</span>`, n, template.HTMLEscapeString(err.Error()))))
+			return
+		}
+		log.Printf("Marked %d transactions of %s reconciled", n, m.AccountName)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// saveMappings stores the mapping form. Accounts set to be ignored lose
+// their mapping, how far they were synced is kept like the Remove mapping
+// button does. Nothing is saved unless every row is valid.
+func (s *Server) saveMappings(w http.ResponseWriter, r *http.Request) {
+	fail := func(msg string) {
+		w.Write([]byte(`<span class="text-red-600">` + template.HTMLEscapeString(msg) + `</span>`))
+	}
+
+	r.ParseForm()
+	basiqIDs := r.Form["basiq_id[]"]
+	basiqNames := r.Form["basiq_name[]"]
+	fireflyIDs := r.Form["firefly_id[]"]
+	schedules := r.Form["schedule[]"]
+	paymentIDs := r.Form["payment_id[]"]
+	startDates := r.Form["start_date[]"]
+	inverts := r.Form["invert_sign[]"]
+	pendings := r.Form["pending_policy[]"]
+	tags := r.Form["tags[]"]
+	categories := r.Form["category[]"]
+	field := func(values []string, i int) string {
+		if i < len(values) {
+			return strings.TrimSpace(values[i])
+		}
+		return ""
+	}
+
+	// Remember what kind of account each mapping points to, the sync
+	// treats credit cards and liabilities differently
+	kinds := make(map[string]string)
+	fAccounts, err := s.fireflyClient().GetAccounts()
+	if err != nil {
+		log.Println("Failed to get Firefly accounts:", err)
+	}
+	for _, a := range fAccounts {
+		kinds[a.ID] = accountKind(a)
+	}
+
+	var removed []string
+	err = s.db.InTx(func(tx storage.Store) error {
+		for i, bid := range basiqIDs {
+			existing, err := tx.GetMappingByBasiqID(bid)
+			if err != nil {
+				return err
+			}
+			fid := field(fireflyIDs, i)
+			if fid == "" {
+				if existing != nil {
+					if err := tx.DeleteMapping(bid); err != nil {
+						return fmt.Errorf("%s: %w", existing.AccountName, err)
+					}
+					removed = append(removed, bid)
+				}
+				continue
+			}
+			name := field(basiqNames, i)
+			sched := field(schedules, i)
+			if sched != "" {
+				if _, err := schedule.Parse(sched); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+			startDate := field(startDates, i)
+			if startDate != "" {
+				if _, err := time.Parse("2006-01-02", startDate); err != nil {
+					return fmt.Errorf("%s: invalid start date %q", name, startDate)
+				}
+			}
+			payment := field(paymentIDs, i)
+			if payment == fid {
+				payment = ""
+			}
+
+			// Pausing is done with its own button, keep whatever was set
+			var disabled bool
+			if existing != nil {
+				disabled = existing.Disabled
+			}
+
+			err = tx.SaveMapping(storage.AccountMapping{
+				BasiqAccountID:     bid,
+				FireflyAccountID:   fid,
+				AccountName:        name,
+				Schedule:           sched,
+				FireflyAccountKind: kinds[fid],
+				PaymentAccountID:   payment,
+				Disabled:           disabled,
+				StartDate:          startDate,
+				InvertSign:         field(inverts, i) == "1",
+				PendingPolicy:      field(pendings, i),
+				Tags:               field(tags, i),
+				Category:           field(categories, i),
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fail("Failed to save mappings: " + err.Error())
+		return
+	}
+	for _, bid := range removed {
+		log.Printf("Deleted mapping for %s, set to be ignored", bid)
+	}
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// handleDeleteMapping removes a mapping, optionally forgetting how far the
+// account was synced so a new mapping starts from scratch
+func (s *Server) handleDeleteMapping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	basiqID := r.FormValue("basiq_id")
+	if basiqID == "" {
+		http.Error(w, "Missing account", http.StatusBadRequest)
+		return
+	}
+	if err := s.db.DeleteMapping(basiqID); err != nil {
+		http.Error(w, "Failed to delete mapping: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("forget") == "1" {
+		for _, key := range []string{
+			"last_sync_" + basiqID,
+			scheduleKey("schedule_expr", basiqID),
+			scheduleKey("schedule_zone", basiqID),
+			scheduleKey("schedule_next_run", basiqID),
+			scheduleKey("schedule_last_run", basiqID),
+		} {
+			if err := s.db.DeleteKV(key); err != nil {
+				log.Printf("Failed to delete %s: %v", key, err)
+			}
+		}
+	}
+	log.Printf("Deleted mapping for %s", basiqID)
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// handleToggleMapping pauses or resumes syncing of a mapping
+func (s *Server) handleToggleMapping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	basiqID := r.FormValue("basiq_id")
+	disabled := r.FormValue("disabled") == "1"
+	if err := s.db.SetMappingDisabled(basiqID, disabled); err != nil {
+		http.Error(w, "Failed to update mapping: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// handleAcceptSuggestions maps every unmapped Basiq account to its suggested
+// Firefly account
+func (s *Server) handleAcceptSuggestions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := s.basiqUserID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bAccounts, err := s.basiqClient().GetAccounts(userID)
+	if err != nil {
+		http.Error(w, "Failed to get Basiq accounts: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	fAccounts, err := s.fireflyClient().GetAccounts()
+	if err != nil {
+		http.Error(w, "Failed to get Firefly accounts: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	existing, err := s.db.GetMappings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapped := make(map[string]string)
+	for _, m := range existing {
+		mapped[m.BasiqAccountID] = m.FireflyAccountID
+	}
+	kinds := make(map[string]string)
+	for _, a := range fAccounts {
+		kinds[a.ID] = accountKind(a)
+	}
+
+	suggestions := suggestMappings(bAccounts, fAccounts, mapped)
+	for _, b := range bAccounts {
+		sug, ok := suggestions[b.ID]
+		if !ok {
+			continue
+		}
+		err := s.db.SaveMapping(storage.AccountMapping{
+			BasiqAccountID:     b.ID,
+			FireflyAccountID:   sug.FireflyID,
+			AccountName:        b.Name,
+			FireflyAccountKind: kinds[sug.FireflyID],
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Mapped %s to Firefly account %s (%d%%, %s)", b.Name, sug.FireflyName, sug.Confidence, sug.Reason)
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func (s *Server) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := s.basiqUserID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	basiqID := r.FormValue("basiq_id")
+	bAccounts, err := s.basiqClient().GetAccounts(userID)
+	if err != nil {
+		http.Error(w, "Failed to get Basiq accounts: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	var account *basiq.Account
+	for i := range bAccounts {
+		if bAccounts[i].ID == basiqID {
+			account = &bAccounts[i]
+		}
+	}
+	if account == nil {
+		http.Error(w, "Unknown Basiq account", http.StatusNotFound)
+		return
+	}
+
+	m, err := s.createFireflyAccount(userID, *account, r.FormValue("kind"))
+	if err != nil {
+		log.Printf("Failed to create Firefly account for %s: %v", basiqID, err)
+		w.Write([]byte(`<span class="text-red-600">` + template.HTMLEscapeString(err.Error()) + `</span>`))
+		return
+	}
+	log.Printf("Created Firefly account %s for %s", m.FireflyAccountID, m.AccountName)
+
+	// Reload so the new account shows up in every dropdown
+	w.Header().Set("HX-Refresh", "true")
+	w.Write([]byte(`<span class="text-green-600">Created</span>`))
+}
+
+// accountGroup is a set of Firefly accounts shown together in the mapping dropdown
+type accountGroup struct {
+	Label    string
+	Accounts []firefly.Account
+}
+
+// groupAccounts sorts Firefly accounts into asset accounts, credit cards,
+// liabilities and everything else, dropping empty groups
+func groupAccounts(accounts []firefly.Account) []accountGroup {
+	groups := []accountGroup{
+		{Label: "Asset accounts"},
+		{Label: "Credit cards"},
+		{Label: "Liabilities"},
+		{Label: "Expense accounts"},
+		{Label: "Revenue accounts"},
+	}
+	for _, a := range accounts {
+		i := 0
+		switch {
+		case a.IsCreditCard():
+			i = 1
+		case a.IsLiability():
+			i = 2
+		case a.Attributes.Type == firefly.AccountTypeExpense:
+			i = 3
+		case a.Attributes.Type == firefly.AccountTypeRevenue:
+			i = 4
+		}
+		groups[i].Accounts = append(groups[i].Accounts, a)
+	}
+
+	var nonEmpty []accountGroup
+	for _, g := range groups {
+		if len(g.Accounts) > 0 {
+			nonEmpty = append(nonEmpty, g)
+		}
+	}
+	return nonEmpty
+}
+
 func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	go func() {
-		if err := s.PerformSync(); err != nil {
-			log.Printf("Manual sync failed: %v", err)
-			s.db.SetKV("last_run_status", fmt.Sprintf("Failed: %v", err))
+	id, err := s.enqueueJob(storage.JobSyncAccount, jobPayload{}, time.Now())
+	if err != nil {
+		log.Printf("Failed to queue manual sync: %v", err)
+		http.Error(w, "Failed to queue sync: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(fmt.Sprintf(`<span class="text-blue-600">Sync queued as <a href="/jobs" class="underline">job #%d</a>, progress is shown below.</span>`, id)))
+}
+
+// handleEvents streams sync progress as Server-Sent Events. By default each
+// event is sent as JSON under its type name, for scripts. With ?view=html
+// events are sent as "progress" HTML snippets for the dashboard.
+// Reconnecting clients get missed events through Last-Event-ID (or ?since=).
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastIDStr := r.Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = r.URL.Query().Get("since")
+	}
+	lastID, _ := strconv.ParseInt(lastIDStr, 10, 64)
+	replay := lastIDStr != ""
+	htmlView := r.URL.Query().Get("view") == "html"
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	ch, backlog := s.events.subscribe(lastID, replay)
+	defer s.events.unsubscribe(ch)
+
+	write := func(e SyncEvent) {
+		if htmlView {
+			fmt.Fprintf(w, "id: %d\nevent: progress\ndata: %s\n\n", e.ID, e.describe())
+			return
+		}
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	}
+
+	// Tell EventSource to reconnect quickly if we go away
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, e := range backlog {
+		write(e)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			write(e)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var p jobPayload
+		jobType := r.FormValue("type")
+		switch jobType {
+		case storage.JobBackfillRange:
+			if a := r.FormValue("account"); a != "" {
+				p.Accounts = []string{a}
+			}
+			p.From = r.FormValue("from")
+			p.To = r.FormValue("to")
+			if p.From == "" {
+				http.Error(w, "A start date is required", http.StatusBadRequest)
+				return
+			}
+		case storage.JobRefreshConnection:
+		default:
+			http.Error(w, "Unsupported job type", http.StatusBadRequest)
+			return
+		}
+
+		id, err := s.enqueueJob(jobType, p, time.Now())
+		if err != nil {
+			http.Error(w, "Failed to queue job: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`<span class="text-blue-600">Queued job #%d.</span>`, id)))
+		return
+	}
+
+	jobs, err := s.db.GetJobs(100)
+	if err != nil {
+		http.Error(w, "Failed to load jobs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mappings, _ := s.db.GetMappings()
+
+	data := struct {
+		Year     int
+		Jobs     []storage.Job
+		Mappings []storage.AccountMapping
+	}{
+		Year:     time.Now().Year(),
+		Jobs:     jobs,
+		Mappings: mappings,
+	}
+
+	s.render(w, "jobs.html", data)
+}
+
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid job id", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := s.cancelJob(id)
+	if err != nil {
+		http.Error(w, "Failed to cancel job: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.Write([]byte(`<span class="text-gray-500">already finished</span>`))
+		return
+	}
+	w.Write([]byte(`<span class="text-gray-500">cancelled</span>`))
+}
+
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := s.db.GetRuns(50)
+	if err != nil {
+		http.Error(w, "Failed to load runs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var selected *storage.SyncRun
+	var accounts []storage.SyncRunAccount
+	if idStr := r.URL.Query().Get("id"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid run id", http.StatusBadRequest)
+			return
+		}
+		selected, err = s.db.GetRun(id)
+		if err != nil {
+			http.Error(w, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-	}()
+		if selected == nil {
+			http.NotFound(w, r)
+			return
+		}
+		accounts, _ = s.db.GetRunAccounts(id)
+	}
 
-	w.Write([]byte(`<span class="text-blue-600">Sync started in background... Refresh to see status.</span>`))
+	data := struct {
+		Year     int
+		Runs     []storage.SyncRun
+		Selected *storage.SyncRun
+		Accounts []storage.SyncRunAccount
+	}{
+		Year:     time.Now().Year(),
+		Runs:     runs,
+		Selected: selected,
+		Accounts: accounts,
+	}
+
+	s.render(w, "runs.html", data)
+}
+
+func (s *Server) handleFailed(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != storage.FailedDismissed && status != storage.FailedResolved {
+		status = storage.FailedPending
+	}
+
+	failed, err := s.db.GetFailedTransactions(status)
+	if err != nil {
+		http.Error(w, "Failed to load failed transactions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Indent the payloads so they are editable
+	type failedView struct {
+		storage.FailedTransaction
+		PrettyPayload string
+	}
+	views := make([]failedView, 0, len(failed))
+	for _, f := range failed {
+		v := failedView{FailedTransaction: f, PrettyPayload: f.FireflyPayload}
+		var buf bytes.Buffer
+		if json.Indent(&buf, []byte(f.FireflyPayload), "", "  ") == nil {
+			v.PrettyPayload = buf.String()
+		}
+		views = append(views, v)
+	}
+
+	data := struct {
+		Year   int
+		Status string
+		Failed []failedView
+	}{
+		Year:   time.Now().Year(),
+		Status: status,
+		Failed: views,
+	}
+
+	s.render(w, "failed.html", data)
+}
+
+// handleFailedAction handles the retry, edit and dismiss buttons on the
+// failed transactions page
+func (s *Server) handleFailedAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	f, err := s.db.GetFailedTransaction(id)
+	if err != nil {
+		http.Error(w, "Failed to load transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/failed/edit":
+		payload := r.FormValue("payload")
+		var ffTx firefly.Transaction
+		dec := json.NewDecoder(strings.NewReader(payload))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&ffTx); err != nil {
+			http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		compact, _ := json.Marshal(ffTx)
+		if err := s.db.UpdateFailedPayload(id, string(compact)); err != nil {
+			http.Error(w, "Failed to save payload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`<span class="text-green-600">Saved</span>`))
+
+	case "/failed/retry":
+		if f.Status == storage.FailedDismissed {
+			s.db.SetFailedStatus(id, storage.FailedPending)
+		}
+		jobID, err := s.enqueueJob(storage.JobRetryFailedTx, jobPayload{
+			Accounts:      []string{f.BasiqAccountID},
+			TransactionID: f.BasiqTransactionID,
+		}, time.Now())
+		if err != nil {
+			http.Error(w, "Failed to queue retry: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`<span class="text-blue-600">Retry queued (job #%d)</span>`, jobID)))
+
+	case "/failed/dismiss":
+		if err := s.db.SetFailedStatus(id, storage.FailedDismissed); err != nil {
+			http.Error(w, "Failed to dismiss: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`<span class="text-gray-500">Dismissed</span>`))
+
+	default:
+		http.NotFound(w, r)
+	}
 }
 
 func (s *Server) render(w http.ResponseWriter, tmpl string, data interface{}) {
@@ -182,3 +989,282 @@ func (s *Server) render(w http.ResponseWriter, tmpl string, data interface{}) {
 	}
 	t.Execute(w, data)
 }
+
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	changes, err := s.pendingChanges()
+	if err != nil {
+		http.Error(w, "Failed to load changes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	vanished, err := s.vanishedForReview()
+	if err != nil {
+		http.Error(w, "Failed to load vanished transactions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cfg := s.config()
+	data := struct {
+		Year         int
+		Changes      []pendingChange
+		Mode         string
+		Vanished     []vanishedTransaction
+		VanishedMode string
+	}{
+		Year:         time.Now().Year(),
+		Changes:      changes,
+		Mode:         cfg.ChangedTransactions,
+		Vanished:     vanished,
+		VanishedMode: cfg.VanishedTransactions,
+	}
+	s.render(w, "changes.html", data)
+}
+
+func (s *Server) handleChangeAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.FormValue("id")
+	imp, err := s.db.GetImported(id)
+	if err != nil {
+		http.Error(w, "Failed to load transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if imp == nil || imp.PendingHash == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/ignore") {
+		err = s.db.IgnorePendingChange(id)
+	} else {
+		err = s.acceptChange(imp)
+	}
+	if err != nil {
+		w.Write([]byte(`<span class="text-red-600">` + template.HTMLEscapeString(err.Error()) + `</span>`))
+		return
+	}
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func (s *Server) handleVanishedAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	action := r.FormValue("action")
+	if action != vanishedDelete && action != vanishedTag && action != storage.ImportKept {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	imp, err := s.db.GetImported(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to load transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if imp == nil || imp.State != storage.ImportReview {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.resolveVanished(s.fireflyClient(), imp, action); err != nil {
+		w.Write([]byte(`<span class="text-red-600">` + template.HTMLEscapeString(err.Error()) + `</span>`))
+		return
+	}
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func (s *Server) handleMatches(w http.ResponseWriter, r *http.Request) {
+	held, err := s.heldMatches()
+	if err != nil {
+		http.Error(w, "Failed to load matches: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cfg := s.config()
+	data := struct {
+		Year      int
+		Matches   []heldMatch
+		Enabled   bool
+		Tolerance int
+	}{
+		Year:      time.Now().Year(),
+		Matches:   held,
+		Enabled:   cfg.MatchExisting,
+		Tolerance: cfg.MatchToleranceDays,
+	}
+	s.render(w, "matches.html", data)
+}
+
+func (s *Server) handleMatchAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	review, err := s.db.GetMatchReview(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to load transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if review == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	groupID := ""
+	if strings.HasSuffix(r.URL.Path, "/link") {
+		groupID = r.FormValue("group")
+		if groupID == "" {
+			http.Error(w, "Missing Firefly transaction", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.resolveMatch(review, groupID); err != nil {
+		w.Write([]byte(`<span class="text-red-600">` + template.HTMLEscapeString(err.Error()) + `</span>`))
+		return
+	}
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func (s *Server) handleDismissLegacy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.db.DismissLegacyImport(); err != nil {
+		http.Error(w, "Failed to dismiss: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	var backups []storage.BackupFile
+	var err error
+	if cfg.BackupDir != "" {
+		backups, err = storage.ListBackups(cfg.BackupDir)
+	}
+	data := struct {
+		Year     int
+		Dir      string
+		Schedule string
+		Keep     int
+		SQLite   bool
+		Backups  []storage.BackupFile
+		Error    error
+	}{
+		Year:     time.Now().Year(),
+		Dir:      cfg.BackupDir,
+		Schedule: cfg.BackupSchedule,
+		Keep:     cfg.BackupKeep,
+		SQLite:   s.db.Driver() == storage.DriverSQLite,
+		Backups:  backups,
+		Error:    err,
+	}
+	s.render(w, "backup.html", data)
+}
+
+// handleExport downloads the configuration as a JSON archive
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	// Credentials are never sent to the browser
+	archive, err := s.db.Export(false)
+	if err != nil {
+		http.Error(w, "Failed to export: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="fidi-export-%s.json"`, time.Now().Format("20060102-150405")))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(archive)
+}
+
+// handleRestore reads an uploaded archive into the database
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fail := func(msg string) {
+		w.Write([]byte(`<span class="text-red-600">` + template.HTMLEscapeString(msg) + `</span>`))
+	}
+
+	file, _, err := r.FormFile("archive")
+	if err != nil {
+		fail("Choose an export file first")
+		return
+	}
+	defer file.Close()
+	var archive storage.Archive
+	if err := json.NewDecoder(file).Decode(&archive); err != nil {
+		fail("Not a valid export: " + err.Error())
+		return
+	}
+	report, err := s.db.Restore(&archive, r.FormValue("overwrite") == "on")
+	if err != nil {
+		fail("Restore failed: " + err.Error())
+		return
+	}
+	log.Printf("Restored export from %s: %d settings, %d mappings, %d imported transactions, %d repayments",
+		archive.ExportedAt.Format(time.RFC3339), report.Settings, report.Mappings, report.Imported, report.RepaymentLegs)
+	fmt.Fprintf(w, `<p class="text-green-600">Restored %d settings, %d mappings, %d imported transactions and %d repayments.</p>`,
+		report.Settings, report.Mappings, report.Imported, report.RepaymentLegs)
+	for _, line := range report.Kept() {
+		log.Print(line)
+		fmt.Fprintf(w, `<p class="text-gray-600">%s.</p>`, template.HTMLEscapeString(line))
+	}
+	for _, note := range report.Notes {
+		log.Print(note)
+		fmt.Fprintf(w, `<p class="text-yellow-600">%s</p>`, template.HTMLEscapeString(note))
+	}
+}
+
+// handleBackupNow takes a backup right away
+func (s *Server) handleBackupNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := s.config()
+	if cfg.BackupDir == "" {
+		w.Write([]byte(`<span class="text-red-600">Set BACKUP_DIR to take backups</span>`))
+		return
+	}
+	if _, err := s.db.BackupTo(cfg.BackupDir, cfg.BackupKeep); err != nil {
+		w.Write([]byte(`<span class="text-red-600">` + template.HTMLEscapeString(err.Error()) + `</span>`))
+		return
+	}
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// handleDiagnostics shows the configuration in effect, without secrets
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	version, err := s.db.SchemaVersion()
+	if err != nil {
+		http.Error(w, "Failed to read schema version: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cfg := s.config()
+	restart := make(map[string]bool)
+	for _, name := range cfg.RestartNeeded(s.started) {
+		restart[name] = true
+	}
+	data := struct {
+		Year          int
+		File          string
+		Settings      []config.Setting
+		Restart       map[string]bool
+		Driver        string
+		SchemaVersion int
+	}{
+		Year:          time.Now().Year(),
+		File:          cfg.File,
+		Settings:      cfg.Effective(),
+		Restart:       restart,
+		Driver:        s.db.Driver(),
+		SchemaVersion: version,
+	}
+	s.render(w, "diagnostics.html", data)
+}
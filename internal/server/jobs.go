@@ -0,0 +1,412 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"fidi/internal/basiq"
+	"fidi/internal/firefly"
+	"fidi/internal/storage"
+)
+
+// jobLease is how long a worker owns a job before another worker may take
+// it over. Leases are extended while the job runs, so this only matters
+// when the process dies mid-job.
+const jobLease = 5 * time.Minute
+
+// jobPayload is the JSON payload shared by all job types. Which fields are
+// used depends on the job type.
+type jobPayload struct {
+	// Accounts are Basiq account IDs, empty means every mapped account
+	Accounts []string `json:"accounts,omitempty"`
+	// From and To are inclusive YYYY-MM-DD dates for backfills and retries
+	From          string `json:"from,omitempty"`
+	To            string `json:"to,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	RunID         int64  `json:"run_id,omitempty"`
+}
+
+var jobMaxAttempts = map[string]int{
+	storage.JobSyncAccount:       3,
+	storage.JobBackfillRange:     3,
+	storage.JobRefreshConnection: 3,
+	storage.JobRetryFailedTx:     5,
+	storage.JobRollbackRun:       3,
+	storage.JobBackup:            2,
+}
+
+// jobRunner tracks the jobs running in this process so they can be
+// cancelled, and the accounts they are importing into
+type jobRunner struct {
+	mu      sync.Mutex
+	running map[int64]context.CancelFunc
+	// syncing holds the Basiq accounts being imported, the channel is
+	// closed when the account is free again
+	syncing map[string]chan struct{}
+	wake    chan struct{}
+}
+
+func newJobRunner() *jobRunner {
+	return &jobRunner{
+		running: make(map[int64]context.CancelFunc),
+		syncing: make(map[string]chan struct{}),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// tryLockAccount claims an account for importing, false if another job
+// is importing into it already
+func (j *jobRunner) tryLockAccount(accountID string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, held := j.syncing[accountID]; held {
+		return false
+	}
+	j.syncing[accountID] = make(chan struct{})
+	return true
+}
+
+// lockAccount claims an account for importing, waiting for any job
+// importing into it to finish
+func (j *jobRunner) lockAccount(ctx context.Context, accountID string) error {
+	for {
+		j.mu.Lock()
+		done, held := j.syncing[accountID]
+		if !held {
+			j.syncing[accountID] = make(chan struct{})
+			j.mu.Unlock()
+			return nil
+		}
+		j.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (j *jobRunner) unlockAccount(accountID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	close(j.syncing[accountID])
+	delete(j.syncing, accountID)
+}
+
+// enqueueJob queues a job and wakes an idle worker
+func (s *Server) enqueueJob(jobType string, p jobPayload, at time.Time) (int64, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return 0, err
+	}
+	id, err := s.db.EnqueueJob(jobType, string(payload), at, jobMaxAttempts[jobType])
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case s.jobs.wake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// cancelJob cancels a queued job, or stops it if it is running here
+func (s *Server) cancelJob(id int64) (bool, error) {
+	ok, err := s.db.CancelJob(id)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	s.jobs.mu.Lock()
+	if cancel, running := s.jobs.running[id]; running {
+		cancel()
+	}
+	s.jobs.mu.Unlock()
+	return true, nil
+}
+
+// StartWorkers starts n workers processing the job queue
+func (s *Server) StartWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	host, _ := os.Hostname()
+	for i := 0; i < n; i++ {
+		go s.worker(fmt.Sprintf("%s-%d-%d", host, os.Getpid(), i))
+	}
+
+	// Keep the job table from growing forever
+	go func() {
+		for {
+			if err := s.db.PruneJobs(time.Now().AddDate(0, 0, -30)); err != nil {
+				log.Printf("Failed to prune jobs: %v", err)
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+func (s *Server) worker(owner string) {
+	for {
+		job, err := s.db.LeaseJob(owner, jobLease)
+		if err != nil {
+			log.Printf("Worker %s failed to lease job: %v", owner, err)
+		}
+		if job == nil {
+			select {
+			case <-s.jobs.wake:
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+
+		s.processJob(owner, job)
+	}
+}
+
+func (s *Server) processJob(owner string, job *storage.Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.jobs.mu.Lock()
+	s.jobs.running[job.ID] = cancel
+	s.jobs.mu.Unlock()
+	defer func() {
+		s.jobs.mu.Lock()
+		delete(s.jobs.running, job.ID)
+		s.jobs.mu.Unlock()
+	}()
+
+	// Heartbeat so other workers don't take the job over
+	go func() {
+		ticker := time.NewTicker(jobLease / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.db.ExtendLease(job.ID, owner, jobLease); err != nil {
+					log.Printf("Failed to extend lease of job %d: %v", job.ID, err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("Running job %d (%s, attempt %d)", job.ID, job.Type, job.Attempts)
+	err := s.runJobSafely(ctx, job)
+
+	if err == nil {
+		if err := s.db.CompleteJob(job.ID); err != nil {
+			log.Printf("Failed to complete job %d: %v", job.ID, err)
+		}
+		return
+	}
+
+	if ctx.Err() != nil {
+		log.Printf("Job %d cancelled", job.ID)
+		return
+	}
+
+	log.Printf("Job %d failed: %v", job.ID, err)
+	retryAt := time.Now().Add(time.Duration(job.Attempts*job.Attempts) * time.Minute)
+	if err := s.db.FailJob(job.ID, err.Error(), retryAt); err != nil {
+		log.Printf("Failed to record failure of job %d: %v", job.ID, err)
+	}
+}
+
+// runJobSafely runs a job, turning a panic into a failure of the job so
+// the worker carries on with the next one
+func (s *Server) runJobSafely(ctx context.Context, job *storage.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job %d panicked: %v\n%s", job.ID, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.runJob(ctx, job)
+}
+
+func (s *Server) runJob(ctx context.Context, job *storage.Job) error {
+	var p jobPayload
+	if job.Payload != "" {
+		if err := json.Unmarshal([]byte(job.Payload), &p); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+	}
+
+	// Backups don't need Basiq
+	if job.Type == storage.JobBackup {
+		_, err := s.db.BackupTo(s.config().BackupDir, s.config().BackupKeep)
+		return err
+	}
+
+	userID, err := s.basiqUserID()
+	if err != nil {
+		return err
+	}
+
+	switch job.Type {
+	case storage.JobSyncAccount:
+		mappings, err := s.mappingsFor(p.Accounts)
+		if err != nil {
+			return err
+		}
+		err = s.syncMappings(ctx, userID, mappings)
+		if err != nil && ctx.Err() == nil {
+			s.db.SetKV("last_run_status", fmt.Sprintf("Failed: %v", err))
+		}
+		return err
+
+	case storage.JobBackfillRange:
+		return s.backfill(ctx, userID, p)
+
+	case storage.JobRefreshConnection:
+		return s.basiqClient().RefreshConnections(userID)
+
+	case storage.JobRetryFailedTx:
+		return s.retryTransaction(ctx, userID, p)
+
+	case storage.JobRollbackRun:
+		return s.rollbackRun(ctx, p.RunID)
+	}
+
+	return fmt.Errorf("unknown job type %q", job.Type)
+}
+
+// mappingsFor returns the enabled mappings for the given Basiq account IDs,
+// or all enabled mappings if none are given
+func (s *Server) mappingsFor(accounts []string) ([]storage.AccountMapping, error) {
+	mappings, err := s.db.GetMappings()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mappings: %w", err)
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range accounts {
+		wanted[id] = true
+	}
+	var filtered []storage.AccountMapping
+	for _, m := range mappings {
+		if !m.Disabled && (len(accounts) == 0 || wanted[m.BasiqAccountID]) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered, nil
+}
+
+// dayBefore turns an inclusive start date into Basiq's exclusive "since"
+func dayBefore(date string) (string, error) {
+	if date == "" {
+		return "", nil
+	}
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q", date)
+	}
+	return t.AddDate(0, 0, -1).Format("2006-01-02"), nil
+}
+
+// backfill imports a date range without touching the sync cursors
+func (s *Server) backfill(ctx context.Context, userID string, p jobPayload) error {
+	mappings, err := s.mappingsFor(p.Accounts)
+	if err != nil {
+		return err
+	}
+	if len(mappings) == 0 {
+		return fmt.Errorf("no accounts mapped")
+	}
+	since, err := dayBefore(p.From)
+	if err != nil {
+		return err
+	}
+
+	bClient := s.basiqClient()
+	fClient := s.fireflyClient()
+
+	for _, m := range mappings {
+		if err := s.backfillAccount(ctx, bClient, fClient, userID, m, since, p.To); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillAccount imports a date range of one account, once no sync is
+// importing into it
+func (s *Server) backfillAccount(ctx context.Context, bClient *basiq.Client, fClient *firefly.Client, userID string, m storage.AccountMapping, since, to string) error {
+	if err := s.jobs.lockAccount(ctx, m.BasiqAccountID); err != nil {
+		return err
+	}
+	defer s.jobs.unlockAccount(m.BasiqAccountID)
+
+	txs, err := bClient.GetTransactionsRange(userID, m.BasiqAccountID, since, to)
+	if err != nil {
+		return fmt.Errorf("fetching transactions for %s: %w", m.BasiqAccountID, err)
+	}
+	res, err := s.importTransactions(ctx, fClient, 0, m, txs, since)
+	log.Printf("Backfill imported %d transactions for account %s (%d skipped, %d failed)", res.Imported, m.BasiqAccountID, res.Skipped, res.Failed)
+	return err
+}
+
+// retryTransaction retries a failed transaction. Transactions in the
+// dead-letter table are retried from their stored payload, anything else
+// is fetched from Basiq again.
+func (s *Server) retryTransaction(ctx context.Context, userID string, p jobPayload) error {
+	if p.TransactionID == "" {
+		return fmt.Errorf("retry needs a transaction id")
+	}
+	fClient := s.fireflyClient()
+
+	failed, err := s.db.GetFailedTransactionByBasiqID(p.TransactionID)
+	if err != nil {
+		return err
+	}
+	if failed != nil {
+		if failed.Status != storage.FailedPending {
+			return nil
+		}
+		if err := s.jobs.lockAccount(ctx, failed.BasiqAccountID); err != nil {
+			return err
+		}
+		defer s.jobs.unlockAccount(failed.BasiqAccountID)
+		return s.retryFailed(fClient, 0, failed)
+	}
+
+	if len(p.Accounts) != 1 {
+		return fmt.Errorf("retry needs exactly one account")
+	}
+	mappings, err := s.mappingsFor(p.Accounts)
+	if err != nil {
+		return err
+	}
+	if len(mappings) == 0 {
+		return fmt.Errorf("account %s is not mapped", p.Accounts[0])
+	}
+	since, err := dayBefore(p.From)
+	if err != nil {
+		return err
+	}
+
+	txs, err := s.basiqClient().GetTransactionsRange(userID, p.Accounts[0], since, p.To)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		if tx.ID == p.TransactionID {
+			if err := s.jobs.lockAccount(ctx, p.Accounts[0]); err != nil {
+				return err
+			}
+			defer s.jobs.unlockAccount(p.Accounts[0])
+			return s.importTransaction(fClient, mappings[0], tx)
+		}
+	}
+	return fmt.Errorf("transaction %s not found at Basiq", p.TransactionID)
+}
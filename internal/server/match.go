@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"fidi/internal/basiq"
+	"fidi/internal/firefly"
+	"fidi/internal/storage"
+)
+
+var (
+	// errNoMatch means nothing in Firefly looks like the transaction yet
+	errNoMatch = errors.New("no matching transaction in Firefly")
+	// errLinked marks a transaction that was entered in Firefly by hand
+	// and is now linked instead of created again
+	errLinked = errors.New("linked to an existing Firefly transaction")
+	// errMatchFlagged marks a transaction with several possible matches,
+	// held for review
+	errMatchFlagged = errors.New("several possible matches in Firefly, waiting for review")
+	// errLinkNotRecorded means a link couldn't be written to the ledger and
+	// was undone, the next sync links the transaction again
+	errLinkNotRecorded = errors.New("link to the existing Firefly transaction could not be recorded")
+)
+
+// matchCandidate is a Firefly transaction a Basiq transaction may already be
+type matchCandidate struct {
+	GroupID     string
+	JournalID   string
+	Date        string
+	Description string
+	Amount      string
+}
+
+// existingMatcher finds transactions entered by hand in Firefly on one
+// account. The account's transactions are fetched once, on first use.
+type existingMatcher struct {
+	fClient    *firefly.Client
+	accountID  string
+	start, end string
+	tolerance  int
+
+	once   sync.Once
+	err    error
+	groups []firefly.TransactionGroup
+
+	mu      sync.Mutex
+	claimed map[string]bool
+}
+
+// newMatcher prepares matching for the given transactions, sorted oldest
+// first. It returns nil when matching is switched off.
+func (s *Server) newMatcher(fClient *firefly.Client, m storage.AccountMapping, txs []basiq.Transaction) *existingMatcher {
+	cfg := s.config()
+	if !cfg.MatchExisting || len(txs) == 0 {
+		return nil
+	}
+	first, err1 := time.Parse("2006-01-02", day(txs[0].PostDate))
+	last, err2 := time.Parse("2006-01-02", day(txs[len(txs)-1].PostDate))
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return &existingMatcher{
+		fClient:   fClient,
+		accountID: m.FireflyAccountID,
+		start:     first.AddDate(0, 0, -cfg.MatchToleranceDays).Format("2006-01-02"),
+		end:       last.AddDate(0, 0, cfg.MatchToleranceDays).Format("2006-01-02"),
+		tolerance: cfg.MatchToleranceDays,
+		claimed:   make(map[string]bool),
+	}
+}
+
+// day is the date part of a Basiq or Firefly timestamp
+func day(date string) string {
+	return date[:min(len(date), 10)]
+}
+
+// match returns the one transaction in Firefly that ffTx could be, claimed
+// so nothing else links to it, or all of them if there are several. Only
+// transactions without an external ID are considered, anything imported
+// has one.
+func (mt *existingMatcher) match(ffTx firefly.Transaction) (*matchCandidate, []matchCandidate, error) {
+	mt.once.Do(func() {
+		mt.groups, mt.err = mt.fClient.GetAccountTransactions(mt.accountID, mt.start, mt.end)
+	})
+	if mt.err != nil {
+		return nil, nil, fmt.Errorf("looking for existing transactions: %w", mt.err)
+	}
+	date, err := time.Parse("2006-01-02", day(ffTx.Date))
+	if err != nil {
+		return nil, nil, nil
+	}
+	outgoing := ffTx.SourceID == mt.accountID
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	var found []matchCandidate
+	for _, g := range mt.groups {
+		// Split transactions are left alone, they can't be one bank transaction
+		if len(g.Splits) != 1 || mt.claimed[g.ID] {
+			continue
+		}
+		sp := g.Splits[0]
+		if sp.ExternalID != "" || !sameAmount(sp.Amount, ffTx.Amount) {
+			continue
+		}
+		if (outgoing && sp.SourceID != mt.accountID) || (!outgoing && sp.DestID != mt.accountID) {
+			continue
+		}
+		d, err := time.Parse("2006-01-02", day(sp.Date))
+		if err != nil || d.Sub(date).Abs() > time.Duration(mt.tolerance)*24*time.Hour {
+			continue
+		}
+		found = append(found, matchCandidate{GroupID: g.ID, JournalID: sp.JournalID, Date: day(sp.Date),
+			Description: sp.Description, Amount: sp.Amount})
+	}
+
+	if len(found) == 1 {
+		mt.claimed[found[0].GroupID] = true
+		return &found[0], nil, nil
+	}
+	return nil, found, nil
+}
+
+// linkExisting looks for the transaction in Firefly before it is created.
+// A single match is linked, several are held for review. errNoMatch means
+// the transaction should be created.
+func (s *Server) linkExisting(fClient *firefly.Client, mt *existingMatcher, m storage.AccountMapping, tx basiq.Transaction, ffTx firefly.Transaction) error {
+	if mt == nil {
+		return errNoMatch
+	}
+	held, err := s.db.GetMatchReview(tx.ID)
+	if err != nil {
+		return err
+	}
+	if held != nil {
+		return errMatchFlagged
+	}
+
+	match, ambiguous, err := mt.match(ffTx)
+	if err != nil {
+		return err
+	}
+	if match != nil {
+		return s.linkTransaction(fClient, m, tx, ffTx, *match)
+	}
+	if len(ambiguous) == 0 {
+		return errNoMatch
+	}
+
+	log.Printf("Transaction %s could be one of %d in Firefly, holding for review", tx.ID, len(ambiguous))
+	source, _ := json.Marshal(tx)
+	payload, _ := json.Marshal(ffTx)
+	candidates, _ := json.Marshal(ambiguous)
+	err = s.db.SaveMatchReview(storage.MatchReview{
+		BasiqTransactionID: tx.ID,
+		BasiqAccountID:     m.BasiqAccountID,
+		SourcePayload:      string(source),
+		FireflyPayload:     string(payload),
+		Candidates:         string(candidates),
+	})
+	if err != nil {
+		return err
+	}
+	return errMatchFlagged
+}
+
+// linkTransaction marks a Firefly transaction as the import of a Basiq
+// transaction. It isn't tied to a run, so rolling back never deletes it,
+// and it is never deleted when it vanishes from Basiq either.
+func (s *Server) linkTransaction(fClient *firefly.Client, m storage.AccountMapping, tx basiq.Transaction, ffTx firefly.Transaction, c matchCandidate) error {
+	err := fClient.UpdateTransaction(c.GroupID, firefly.TransactionUpdate{JournalID: c.JournalID, ExternalID: &tx.ID})
+	if err != nil {
+		return err
+	}
+	rec := importedRecord(0, m.BasiqAccountID, tx, ffTx, &firefly.CreatedTransaction{GroupID: c.GroupID, JournalID: c.JournalID})
+	rec.Linked = true
+	if err := s.db.SaveImported(rec); err != nil {
+		// Unknown to the ledger, the next sync would no longer match the
+		// transaction (it has an external ID now) and create it again
+		none := ""
+		if undoErr := fClient.UpdateTransaction(c.GroupID, firefly.TransactionUpdate{JournalID: c.JournalID, ExternalID: &none}); undoErr != nil {
+			log.Printf("Failed to undo link of transaction %s to %s, clear its external ID in Firefly: %v", tx.ID, c.GroupID, undoErr)
+		}
+		return fmt.Errorf("%w: %v", errLinkNotRecorded, err)
+	}
+	log.Printf("Linked transaction %s to existing Firefly transaction %s (%s)", tx.ID, c.GroupID, c.Description)
+	return errLinked
+}
+
+// heldMatch is a transaction waiting for a match decision, as shown on the
+// review page
+type heldMatch struct {
+	storage.MatchReview
+	AccountName string
+	Transaction firefly.Transaction
+	Candidates  []matchCandidate
+}
+
+// heldMatches loads the transactions waiting for a match decision
+func (s *Server) heldMatches() ([]heldMatch, error) {
+	reviews, err := s.db.GetMatchReviews()
+	if err != nil {
+		return nil, err
+	}
+	names, err := s.accountNames()
+	if err != nil {
+		return nil, err
+	}
+
+	held := make([]heldMatch, 0, len(reviews))
+	for _, r := range reviews {
+		h := heldMatch{MatchReview: r, AccountName: names[r.BasiqAccountID]}
+		json.Unmarshal([]byte(r.FireflyPayload), &h.Transaction)
+		json.Unmarshal([]byte(r.Candidates), &h.Candidates)
+		held = append(held, h)
+	}
+	return held, nil
+}
+
+// resolveMatch links a held transaction to the chosen Firefly transaction,
+// or creates it when groupID is empty
+func (s *Server) resolveMatch(r *storage.MatchReview, groupID string) error {
+	var tx basiq.Transaction
+	var ffTx firefly.Transaction
+	var candidates []matchCandidate
+	if err := json.Unmarshal([]byte(r.SourcePayload), &tx); err != nil {
+		return fmt.Errorf("invalid source payload: %w", err)
+	}
+	if err := json.Unmarshal([]byte(r.FireflyPayload), &ffTx); err != nil {
+		return fmt.Errorf("invalid firefly payload: %w", err)
+	}
+	json.Unmarshal([]byte(r.Candidates), &candidates)
+
+	m, err := s.db.GetMappingByBasiqID(r.BasiqAccountID)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("account %s is no longer mapped", r.BasiqAccountID)
+	}
+	fClient := s.fireflyClient()
+
+	if groupID == "" {
+		err = s.createTransaction(fClient, 0, *m, tx, ffTx)
+	} else {
+		err = fmt.Errorf("transaction %s is not one of the candidates", groupID)
+		for _, c := range candidates {
+			if c.GroupID == groupID {
+				err = s.linkTransaction(fClient, *m, tx, ffTx, c)
+			}
+		}
+	}
+	if err != nil && !isSkipped(err) {
+		return err
+	}
+	return s.db.DeleteMatchReview(r.BasiqTransactionID)
+}
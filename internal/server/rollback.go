@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"fidi/internal/storage"
+)
+
+// rollbackRun deletes the transactions a sync run created from Firefly and
+// rewinds the cursors of its accounts, so the next sync imports them again
+// with whatever rules and mappings are in place by then
+func (s *Server) rollbackRun(ctx context.Context, runID int64) error {
+	run, err := s.db.GetRun(runID)
+	if err != nil {
+		return err
+	}
+	if run == nil {
+		return fmt.Errorf("run %d not found", runID)
+	}
+	if run.Status == storage.RunRunning {
+		return fmt.Errorf("run %d is still running", runID)
+	}
+
+	imported, err := s.db.GetImportedByRun(runID)
+	if err != nil {
+		return err
+	}
+
+	fClient := s.fireflyClient()
+	for _, t := range imported {
+		if err := s.fireflyLimit.acquire(ctx); err != nil {
+			return err
+		}
+		err := fClient.DeleteTransaction(t.FireflyGroupID)
+		s.fireflyLimit.release()
+		if err != nil {
+			return fmt.Errorf("deleting transaction %s: %w", t.FireflyGroupID, err)
+		}
+
+		if err := s.db.DeleteImported(t.BasiqTransactionID); err != nil {
+			return err
+		}
+		if err := s.db.DeleteRepaymentLeg(t.BasiqTransactionID); err != nil {
+			return err
+		}
+	}
+
+	// Later runs may have moved on, only ever move cursors back. Anything
+	// re-imported that is still in Firefly is skipped as a duplicate.
+	accounts, err := s.db.GetRunAccounts(runID)
+	if err != nil {
+		return err
+	}
+	for _, ra := range accounts {
+		if ra.Since == "" {
+			continue
+		}
+		key := "last_sync_" + ra.BasiqAccountID
+		current, err := s.db.GetKV(key)
+		if err != nil {
+			return err
+		}
+		if current == "" || ra.Since < current {
+			if err := s.db.SetKV(key, ra.Since); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("Rolled back run %d: deleted %d transactions", runID, len(imported))
+	return s.db.SetRunStatus(runID, storage.RunRolledBack)
+}
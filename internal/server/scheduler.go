@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"fidi/internal/schedule"
+	"fidi/internal/storage"
+)
+
+// scheduleEntry is a set of mappings that share a schedule.
+// The global schedule has an empty key, per-mapping schedules are keyed
+// by the Basiq account ID. Entries with a job queue that instead of a sync.
+type scheduleEntry struct {
+	key      string
+	schedule *schedule.Schedule
+	mappings []storage.AccountMapping
+	job      string
+}
+
+// backupScheduleKey keys the backup schedule, it can't clash with a Basiq
+// account ID
+const backupScheduleKey = "backup"
+
+func scheduleKey(prefix, key string) string {
+	if key == "" {
+		return prefix
+	}
+	return prefix + "_" + key
+}
+
+// StartScheduler queues sync jobs according to the configured cron schedules.
+// Next run times are persisted, so a restart neither postpones a run nor
+// loses one: anything that came due while we were down runs on startup.
+// The time zone is looked up on every tick, it can be changed on the
+// settings page.
+func (s *Server) StartScheduler() {
+	go func() {
+		s.runDueSchedules(time.Now().In(s.location()))
+
+		ticker := time.NewTicker(time.Minute)
+		for now := range ticker.C {
+			s.runDueSchedules(now.In(s.location()))
+		}
+	}()
+}
+
+// location returns the time zone schedules are evaluated in
+func (s *Server) location() *time.Location {
+	tz := s.config().Timezone
+	if tz == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Printf("Unknown time zone %q, using local time: %v", tz, err)
+		return time.Local
+	}
+	return loc
+}
+
+func (s *Server) scheduleEntries() ([]scheduleEntry, error) {
+	mappings, err := s.db.GetMappings()
+	if err != nil {
+		return nil, err
+	}
+
+	global, err := schedule.Parse(s.config().SyncSchedule)
+	if err != nil {
+		log.Printf("Invalid global sync schedule, scheduled sync disabled: %v", err)
+	}
+
+	entries := []scheduleEntry{}
+	var defaults []storage.AccountMapping
+	for _, m := range mappings {
+		if m.Disabled {
+			continue
+		}
+		if m.Schedule == "" {
+			defaults = append(defaults, m)
+			continue
+		}
+		sched, err := schedule.Parse(m.Schedule)
+		if err != nil {
+			log.Printf("Invalid schedule for account %s, using global schedule: %v", m.BasiqAccountID, err)
+			defaults = append(defaults, m)
+			continue
+		}
+		entries = append(entries, scheduleEntry{key: m.BasiqAccountID, schedule: sched, mappings: []storage.AccountMapping{m}})
+	}
+
+	if global != nil {
+		entries = append([]scheduleEntry{{schedule: global, mappings: defaults}}, entries...)
+	}
+
+	if s.config().BackupDir != "" && s.db.Driver() == storage.DriverSQLite {
+		sched, err := schedule.Parse(s.config().BackupSchedule)
+		if err != nil {
+			log.Printf("Invalid backup schedule, scheduled backups disabled: %v", err)
+		} else {
+			entries = append(entries, scheduleEntry{key: backupScheduleKey, schedule: sched, job: storage.JobBackup})
+		}
+	}
+	return entries, nil
+}
+
+func (s *Server) runDueSchedules(now time.Time) {
+	entries, err := s.scheduleEntries()
+	if err != nil {
+		log.Printf("Scheduler failed to load mappings: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		due, err := s.scheduleDue(e, now)
+		if err != nil {
+			log.Printf("Scheduler failed to read state: %v", err)
+			continue
+		}
+		if !due {
+			continue
+		}
+
+		if e.job == storage.JobBackup {
+			log.Printf("Queueing scheduled backup (%s)...", e.schedule)
+			if _, err := s.enqueueJob(storage.JobBackup, jobPayload{}, now); err != nil {
+				log.Printf("Failed to queue scheduled backup: %v", err)
+			}
+		} else if len(e.mappings) > 0 {
+			log.Printf("Queueing scheduled sync (%s)...", e.schedule)
+			var accounts []string
+			for _, m := range e.mappings {
+				accounts = append(accounts, m.BasiqAccountID)
+			}
+			if _, err := s.enqueueJob(storage.JobSyncAccount, jobPayload{Accounts: accounts}, now); err != nil {
+				log.Printf("Failed to queue scheduled sync: %v", err)
+				s.db.SetKV("last_run_status", fmt.Sprintf("Failed: %v", err))
+			}
+		}
+
+		s.db.SetKV(scheduleKey("schedule_last_run", e.key), now.Format(time.RFC3339))
+		s.setNextRun(e, time.Now().In(now.Location()))
+	}
+}
+
+// scheduleDue reports whether the entry should run now. The first time an
+// entry is seen, or when its expression or time zone has changed, the next
+// run is computed and stored instead.
+func (s *Server) scheduleDue(e scheduleEntry, now time.Time) (bool, error) {
+	expr, err := s.db.GetKV(scheduleKey("schedule_expr", e.key))
+	if err != nil {
+		return false, err
+	}
+	zone, err := s.db.GetKV(scheduleKey("schedule_zone", e.key))
+	if err != nil {
+		return false, err
+	}
+	nextVal, err := s.db.GetKV(scheduleKey("schedule_next_run", e.key))
+	if err != nil {
+		return false, err
+	}
+
+	// Next runs stored before zones were kept count as computed in the
+	// zone in effect, so a run that came due meanwhile isn't skipped
+	zoneChanged := zone != "" && zone != now.Location().String()
+	if expr != e.schedule.String() || zoneChanged || nextVal == "" {
+		s.setNextRun(e, now)
+		return false, nil
+	}
+
+	next, err := time.Parse(time.RFC3339, nextVal)
+	if err != nil {
+		s.setNextRun(e, now)
+		return false, nil
+	}
+	return !now.Before(next), nil
+}
+
+func (s *Server) setNextRun(e scheduleEntry, from time.Time) {
+	next := e.schedule.Next(from)
+	s.db.SetKV(scheduleKey("schedule_expr", e.key), e.schedule.String())
+	s.db.SetKV(scheduleKey("schedule_zone", e.key), from.Location().String())
+	if next.IsZero() {
+		s.db.SetKV(scheduleKey("schedule_next_run", e.key), "")
+		return
+	}
+	s.db.SetKV(scheduleKey("schedule_next_run", e.key), next.Format(time.RFC3339))
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results of a self-test check
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// selfTestMaxAge is how long /healthz reuses the last self-test before it
+// runs another, so frequent probes don't hit Firefly and Basiq every time
+const selfTestMaxAge = time.Minute
+
+// minFireflyMajor is the oldest Firefly III release the importer is built for
+const minFireflyMajor = 6
+
+type check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// selfTest is one run of every check
+type selfTest struct {
+	Status    string    `json:"status"`
+	CheckedAt time.Time `json:"checked_at"`
+	Checks    []check   `json:"checks"`
+}
+
+// runSelfTest checks that Firefly and Basiq accept the credentials, the
+// database takes writes and the templates parse. The result is kept for
+// the dashboard and /healthz.
+func (s *Server) runSelfTest() *selfTest {
+	s.selfTestRun.Lock()
+	defer s.selfTestRun.Unlock()
+	return s.selfTestLocked()
+}
+
+func (s *Server) selfTestLocked() *selfTest {
+	// The providers are asked at the same time, each can take a while to
+	// time out
+	groups := []func() []check{s.checkFirefly, s.checkBasiq, s.checkDatabase, checkTemplates}
+	results := make([][]check, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = group()
+		}()
+	}
+	wg.Wait()
+
+	t := &selfTest{Status: checkOK, CheckedAt: time.Now()}
+	for _, checks := range results {
+		for _, c := range checks {
+			t.Checks = append(t.Checks, c)
+			if c.Status == checkFail || (c.Status == checkWarn && t.Status == checkOK) {
+				t.Status = c.Status
+			}
+			if c.Status != checkOK {
+				log.Printf("Self-test: %s: %s", c.Name, c.Detail)
+			}
+		}
+	}
+	s.selfTestMu.Lock()
+	s.lastSelfTest = t
+	s.selfTestMu.Unlock()
+	return t
+}
+
+// selfTestResult returns the last self-test, running one if there is none
+// or it is older than maxAge. Callers arriving while one runs wait for it.
+func (s *Server) selfTestResult(maxAge time.Duration) *selfTest {
+	s.selfTestRun.Lock()
+	defer s.selfTestRun.Unlock()
+	if last := s.lastSelfTestResult(); last != nil && time.Since(last.CheckedAt) < maxAge {
+		return last
+	}
+	return s.selfTestLocked()
+}
+
+// lastSelfTestResult returns the last self-test without running one, nil
+// before the first has finished
+func (s *Server) lastSelfTestResult() *selfTest {
+	s.selfTestMu.Lock()
+	defer s.selfTestMu.Unlock()
+	return s.lastSelfTest
+}
+
+func (s *Server) checkFirefly() []check {
+	cfg := s.config()
+	if cfg.FireflyURL == "" || cfg.FireflyAccessToken == "" {
+		return []check{{"Firefly III", checkFail, "URL and access token are not set"}}
+	}
+	client := s.fireflyClient()
+	about, err := client.About()
+	if err != nil {
+		return []check{{"Firefly III", checkFail, err.Error()}}
+	}
+	version := check{"Firefly III", checkOK, fmt.Sprintf("version %s, API %s", about.Version, about.APIVersion)}
+	major, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(about.Version, "v"), ".", 2)[0])
+	if err == nil && major < minFireflyMajor {
+		version.Status = checkWarn
+		version.Detail += fmt.Sprintf(", older than %d.0 which the importer is built for", minFireflyMajor)
+	}
+
+	user, err := client.AboutUser()
+	if err != nil {
+		return []check{version, {"Firefly III user", checkFail, err.Error()}}
+	}
+	token := check{"Firefly III user", checkOK, user.Email}
+	switch {
+	case user.Blocked:
+		token.Status, token.Detail = checkFail, user.Email+" is blocked"
+	case user.Role == "demo":
+		token.Status, token.Detail = checkFail, user.Email+" is a demo user and can't create transactions"
+	}
+	return []check{version, token}
+}
+
+func (s *Server) checkBasiq() []check {
+	if s.config().BasiqAPIKey == "" {
+		return []check{{"Basiq", checkFail, "API key is not set"}}
+	}
+	client := s.basiqClient()
+	if err := client.Authenticate(); err != nil {
+		return []check{{"Basiq", checkFail, err.Error()}}
+	}
+	auth := check{"Basiq", checkOK, "API key accepted"}
+
+	userID, err := s.db.GetKV("basiq_user_id")
+	if err != nil {
+		return []check{auth, {"Basiq user", checkFail, "reading the user ID: " + err.Error()}}
+	}
+	if userID == "" {
+		return []check{auth, {"Basiq user", checkWarn, "no bank connected yet"}}
+	}
+	if _, err := client.GetUser(userID); err != nil {
+		return []check{auth, {"Basiq user", checkFail, fmt.Sprintf("user %s: %v", userID, err)}}
+	}
+	return []check{auth, {"Basiq user", checkOK, userID}}
+}
+
+// checkDatabase writes, reads back and removes a value
+func (s *Server) checkDatabase() []check {
+	const probe = "self_test_probe"
+	value := time.Now().Format(time.RFC3339Nano)
+	if err := s.db.SetKV(probe, value); err != nil {
+		return []check{{"Database", checkFail, "not writable: " + err.Error()}}
+	}
+	defer s.db.DeleteKV(probe)
+	got, err := s.db.GetKV(probe)
+	if err != nil || got != value {
+		return []check{{"Database", checkFail, fmt.Sprintf("read back %q: %v", got, err)}}
+	}
+	version, err := s.db.SchemaVersion()
+	if err != nil {
+		return []check{{"Database", checkFail, err.Error()}}
+	}
+	return []check{{"Database", checkOK, fmt.Sprintf("%s, schema version %d, writable", s.db.Driver(), version)}}
+}
+
+// checkTemplates parses every page the way render does
+func checkTemplates() []check {
+	pages, err := filepath.Glob("web/templates/*.html")
+	if err == nil && len(pages) == 0 {
+		err = fmt.Errorf("no templates in web/templates")
+	}
+	if err != nil {
+		return []check{{"Templates", checkFail, err.Error()}}
+	}
+	var broken []string
+	for _, page := range pages {
+		if filepath.Base(page) == "layout.html" {
+			continue
+		}
+		if _, err := template.ParseFiles("web/templates/layout.html", page); err != nil {
+			broken = append(broken, err.Error())
+		}
+	}
+	if len(broken) > 0 {
+		return []check{{"Templates", checkFail, strings.Join(broken, "; ")}}
+	}
+	return []check{{"Templates", checkOK, fmt.Sprintf("%d pages", len(pages)-1)}}
+}
+
+// handleHealthz reports the self-test as JSON, with 503 when a check failed
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	t := s.selfTestResult(selfTestMaxAge)
+	w.Header().Set("Content-Type", "application/json")
+	if t.Status == checkFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(t)
+}
+
+// handleSelfTest runs the self-test again from the dashboard
+func (s *Server) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.runSelfTest()
+	w.Header().Set("HX-Refresh", "true")
+}
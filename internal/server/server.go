@@ -2,27 +2,72 @@ package server
 
 import (
 	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"fidi/internal/basiq"
 	"fidi/internal/config"
+	"fidi/internal/firefly"
 	"fidi/internal/storage"
 )
 
 type Server struct {
-	cfg *config.Config
-	db  *storage.DB
+	// cfg is replaced as a whole when settings are saved, read it with config()
+	cfg atomic.Pointer[config.Config]
+	db  storage.Store
 	router *http.ServeMux
+	jobs   *jobRunner
+	events *eventHub
+
+	// started is the configuration the server started with, some settings
+	// such as the request limits below only take effect on a restart
+	started *config.Config
+
+	// Requests in flight to each provider, shared by all syncs
+	basiqLimit   limiter
+	fireflyLimit limiter
+
+	// selfTestRun lets one self-test run at a time, selfTestMu guards the
+	// result of the last one
+	selfTestRun  sync.Mutex
+	selfTestMu   sync.Mutex
+	lastSelfTest *selfTest
 }
 
-func New(cfg *config.Config, db *storage.DB) *Server {
+func New(cfg *config.Config, db storage.Store) *Server {
 	s := &Server{
-		cfg:    cfg,
-		db:     db,
-		router: http.NewServeMux(),
+		db:      db,
+		started: cfg,
+		router:  http.NewServeMux(),
+		jobs:    newJobRunner(),
+		events:  newEventHub(),
+
+		basiqLimit:   newLimiter(cfg.BasiqConcurrency),
+		fireflyLimit: newLimiter(cfg.FireflyConcurrency),
 	}
+	s.cfg.Store(cfg)
 	s.routes()
-	s.StartScheduler() // Start the background scheduler
+	s.StartWorkers(cfg.JobWorkers) // Process queued jobs
+	s.StartScheduler()             // Start the background scheduler
+	go s.runSelfTest()             // Report misconfiguration early
 	return s
 }
 
+// config returns the configuration in effect
+func (s *Server) config() *config.Config {
+	return s.cfg.Load()
+}
+
+// basiqClient and fireflyClient use the credentials in effect
+func (s *Server) basiqClient() *basiq.Client {
+	return basiq.New(s.config().BasiqAPIKey)
+}
+
+func (s *Server) fireflyClient() *firefly.Client {
+	cfg := s.config()
+	return firefly.New(cfg.FireflyURL, cfg.FireflyAccessToken)
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.router.ServeHTTP(w, r)
 }
@@ -30,8 +75,38 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *Server) routes() {
 	s.router.HandleFunc("/", s.handleIndex)
 	s.router.HandleFunc("/connect", s.handleConnect)
+	s.router.HandleFunc("/legacy/dismiss", s.handleDismissLegacy)
 	s.router.HandleFunc("/mapping", s.handleMapping)
+	s.router.HandleFunc("/mapping/create", s.handleCreateAccount)
+	s.router.HandleFunc("/mapping/accept", s.handleAcceptSuggestions)
+	s.router.HandleFunc("/mapping/delete", s.handleDeleteMapping)
+	s.router.HandleFunc("/mapping/toggle", s.handleToggleMapping)
+	s.router.HandleFunc("/reconcile", s.handleReconcile)
+	s.router.HandleFunc("/accounts/health", s.handleAccountHealth)
+	s.router.HandleFunc("/runs/rollback", s.handleRollbackRun)
+	s.router.HandleFunc("/changes", s.handleChanges)
+	s.router.HandleFunc("/changes/apply", s.handleChangeAction)
+	s.router.HandleFunc("/changes/ignore", s.handleChangeAction)
+	s.router.HandleFunc("/changes/vanished", s.handleVanishedAction)
+	s.router.HandleFunc("/matches", s.handleMatches)
+	s.router.HandleFunc("/matches/link", s.handleMatchAction)
+	s.router.HandleFunc("/matches/create", s.handleMatchAction)
+	s.router.HandleFunc("/backup", s.handleBackup)
+	s.router.HandleFunc("/backup/export", s.handleExport)
+	s.router.HandleFunc("/backup/restore", s.handleRestore)
+	s.router.HandleFunc("/backup/now", s.handleBackupNow)
+	s.router.HandleFunc("/settings", s.handleSettings)
+	s.router.HandleFunc("/settings/test", s.handleTestSettings)
+	s.router.HandleFunc("/diagnostics", s.handleDiagnostics)
+	s.router.HandleFunc("/diagnostics/selftest", s.handleSelfTest)
+	s.router.HandleFunc("/healthz", s.handleHealthz)
 	s.router.HandleFunc("/sync", s.handleSync)
+	s.router.HandleFunc("/events", s.handleEvents)
+	s.router.HandleFunc("/jobs", s.handleJobs)
+	s.router.HandleFunc("/jobs/cancel", s.handleCancelJob)
+	s.router.HandleFunc("/runs", s.handleRuns)
+	s.router.HandleFunc("/failed", s.handleFailed)
+	s.router.HandleFunc("/failed/", s.handleFailedAction)
 
 	// Static files? If needed.
 	// fs := http.FileServer(http.Dir("web/static"))
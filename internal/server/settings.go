@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"fidi/internal/basiq"
+	"fidi/internal/config"
+	"fidi/internal/firefly"
+	"fidi/internal/storage"
+)
+
+// settingKey is where a setting from the settings page is kept in kv_store
+func settingKey(name string) string {
+	return "setting_" + strings.ToLower(name)
+}
+
+// StoredSettings reads the values saved on the settings page, keyed by
+// setting name, for config.LoadWith
+func StoredSettings(db storage.Store) (map[string]string, error) {
+	stored := make(map[string]string)
+	for _, name := range config.Editable {
+		value, err := db.GetKV(settingKey(name))
+		if err != nil {
+			return nil, fmt.Errorf("setting %s: %w", name, err)
+		}
+		if value != "" {
+			stored[name] = value
+		}
+	}
+	return stored, nil
+}
+
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		s.saveSettings(w, r)
+		return
+	}
+	cfg := s.config()
+	settings := make(map[string]config.Setting)
+	for _, name := range config.Editable {
+		settings[name] = cfg.Setting(name)
+	}
+	data := struct {
+		Year     int
+		Settings map[string]config.Setting
+	}{
+		Year:     time.Now().Year(),
+		Settings: settings,
+	}
+	s.render(w, "settings.html", data)
+}
+
+// formSettings merges the submitted form into the stored settings. Fields
+// locked by the environment or config file are ignored, a blank secret
+// keeps the stored one and a blank value goes back to the default.
+func (s *Server) formSettings(r *http.Request, stored map[string]string) map[string]string {
+	cfg := s.config()
+	merged := make(map[string]string)
+	for name, value := range stored {
+		merged[name] = value
+	}
+	for _, name := range config.Editable {
+		setting := cfg.Setting(name)
+		if setting.Locked() {
+			continue
+		}
+		value := strings.TrimSpace(r.FormValue(name))
+		switch {
+		case name == "MATCH_EXISTING":
+			merged[name] = fmt.Sprint(value == "on")
+		case setting.Secret && r.FormValue(name+"_CLEAR") == "on":
+			delete(merged, name)
+		case setting.Secret && value == "":
+		case value == "":
+			delete(merged, name)
+		default:
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+// saveSettings checks the submitted settings, stores them and puts them in
+// effect right away
+func (s *Server) saveSettings(w http.ResponseWriter, r *http.Request) {
+	fail := func(msg string) {
+		w.Write([]byte(`<span class="text-red-600 whitespace-pre-line">` + template.HTMLEscapeString(msg) + `</span>`))
+	}
+
+	stored, err := StoredSettings(s.db)
+	if err != nil {
+		fail("Failed to read settings: " + err.Error())
+		return
+	}
+	merged := s.formSettings(r, stored)
+	cfg, err := config.LoadWith(merged)
+	if err == nil {
+		err = s.checkTokenURL(r, cfg)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	// The importer wouldn't start again without them
+	if missing := cfg.Missing(); len(missing) > 0 {
+		fail(strings.Join(missing, ", ") + " can't be blank")
+		return
+	}
+
+	err = s.db.InTx(func(tx storage.Store) error {
+		for _, name := range config.Editable {
+			value, ok := merged[name]
+			if !ok {
+				if err := tx.DeleteKV(settingKey(name)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.SetKV(settingKey(name), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fail("Failed to save settings: " + err.Error())
+		return
+	}
+	s.cfg.Store(cfg)
+	log.Printf("Settings saved on the settings page")
+	if restart := cfg.RestartNeeded(s.started); len(restart) > 0 {
+		log.Printf("Changed since startup, restart to apply: %s", strings.Join(restart, ", "))
+	}
+	go s.runSelfTest()
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// checkTokenURL refuses to send the Firefly token in effect to another
+// Firefly URL, it has to be entered again along with the new URL. Otherwise
+// anyone able to submit the form could have the token sent to their server.
+func (s *Server) checkTokenURL(r *http.Request, cfg *config.Config) error {
+	if cfg.FireflyAccessToken == "" || cfg.FireflyURL == s.config().FireflyURL {
+		return nil
+	}
+	if token := cfg.Setting("FIREFLY_III_ACCESS_TOKEN"); token.Locked() {
+		return fmt.Errorf("FIREFLY_III_URL: the access token is set by the %s, change the URL there as well", token.Source)
+	}
+	if strings.TrimSpace(r.FormValue("FIREFLY_III_ACCESS_TOKEN")) == "" {
+		return fmt.Errorf("FIREFLY_III_ACCESS_TOKEN: the Firefly III URL changed, enter the access token again")
+	}
+	return nil
+}
+
+// handleTestSettings tries the submitted Firefly and Basiq credentials
+// without saving them. Blank secrets are taken from the settings in effect,
+// except the Firefly token when the URL changed.
+func (s *Server) handleTestSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stored, err := StoredSettings(s.db)
+	if err == nil {
+		var cfg *config.Config
+		if cfg, err = config.LoadWith(s.formSettings(r, stored)); err == nil {
+			if err = s.checkTokenURL(r, cfg); err == nil {
+				s.testConnections(w, cfg)
+				return
+			}
+		}
+	}
+	w.Write([]byte(`<span class="text-red-600 whitespace-pre-line">` + template.HTMLEscapeString(err.Error()) + `</span>`))
+}
+
+func (s *Server) testConnections(w http.ResponseWriter, cfg *config.Config) {
+	result := func(name string, err error, ok string) {
+		if err != nil {
+			fmt.Fprintf(w, `<p class="text-red-600">%s: %s</p>`, name, template.HTMLEscapeString(err.Error()))
+			return
+		}
+		fmt.Fprintf(w, `<p class="text-green-600">%s: %s</p>`, name, template.HTMLEscapeString(ok))
+	}
+
+	if cfg.FireflyURL == "" || cfg.FireflyAccessToken == "" {
+		result("Firefly III", fmt.Errorf("URL and access token are required"), "")
+	} else if about, err := firefly.New(cfg.FireflyURL, cfg.FireflyAccessToken).About(); err != nil {
+		result("Firefly III", err, "")
+	} else {
+		result("Firefly III", nil, fmt.Sprintf("connected, version %s (API %s)", about.Version, about.APIVersion))
+	}
+
+	if cfg.BasiqAPIKey == "" {
+		result("Basiq", fmt.Errorf("API key is required"), "")
+	} else {
+		result("Basiq", basiq.New(cfg.BasiqAPIKey).Authenticate(), "API key accepted")
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"fidi/internal/basiq"
+	"fidi/internal/firefly"
+)
+
+// minNameSimilarity is how alike two account names have to be before a
+// name match is suggested at all
+const minNameSimilarity = 0.6
+
+// suggestion is a Firefly account we think a Basiq account belongs to
+type suggestion struct {
+	FireflyID   string
+	FireflyName string
+	// Confidence is 0-100
+	Confidence int
+	Reason     string
+}
+
+// Level groups the confidence for display
+func (s suggestion) Level() string {
+	switch {
+	case s.Confidence >= 90:
+		return "high"
+	case s.Confidence >= 70:
+		return "medium"
+	}
+	return "low"
+}
+
+// suggestMappings suggests a Firefly account for every Basiq account that
+// isn't mapped yet. Account numbers are matched first, then names, with
+// the currency breaking ties. Each Firefly account is suggested at most
+// once and never if it is already mapped.
+func suggestMappings(bAccounts []basiq.Account, fAccounts []firefly.Account, mapped map[string]string) map[string]suggestion {
+	taken := make(map[string]bool)
+	for _, fid := range mapped {
+		taken[fid] = true
+	}
+
+	type candidate struct {
+		basiqID string
+		suggestion
+	}
+	var candidates []candidate
+	for _, b := range bAccounts {
+		if mapped[b.ID] != "" {
+			continue
+		}
+		for _, f := range fAccounts {
+			if taken[f.ID] {
+				continue
+			}
+			if s, ok := score(b, f); ok {
+				candidates = append(candidates, candidate{b.ID, s})
+			}
+		}
+	}
+
+	// Best matches claim their accounts first
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+
+	suggestions := make(map[string]suggestion)
+	for _, c := range candidates {
+		if _, done := suggestions[c.basiqID]; done || taken[c.FireflyID] {
+			continue
+		}
+		suggestions[c.basiqID] = c.suggestion
+		taken[c.FireflyID] = true
+	}
+	return suggestions
+}
+
+// score rates how likely a Firefly account is the same as a Basiq account
+func score(b basiq.Account, f firefly.Account) (suggestion, bool) {
+	s := suggestion{FireflyID: f.ID, FireflyName: f.Attributes.Name}
+
+	bNumber := digits(b.AccountNo)
+	switch {
+	case bNumber == "":
+	case bNumber == digits(f.Attributes.AccountNumber) || bNumber == digits(f.Attributes.IBAN):
+		s.Confidence, s.Reason = 100, "account number"
+	case len(bNumber) >= 4 && (sameSuffix(bNumber, digits(f.Attributes.AccountNumber)) || sameSuffix(bNumber, digits(f.Attributes.IBAN))):
+		s.Confidence, s.Reason = 85, "account number ending "+bNumber[len(bNumber)-4:]
+	}
+
+	if s.Confidence == 0 {
+		sim := similarity(normaliseName(b.Name), normaliseName(f.Attributes.Name))
+		if sim < minNameSimilarity {
+			return s, false
+		}
+		s.Confidence, s.Reason = int(sim*80), "similar name"
+	}
+
+	bCurrency, fCurrency := strings.ToUpper(b.Currency), strings.ToUpper(f.Attributes.CurrencyCode)
+	if bCurrency != "" && fCurrency != "" {
+		if bCurrency == fCurrency {
+			s.Confidence += 5
+		} else {
+			s.Confidence -= 30
+			s.Reason += ", different currency"
+		}
+	}
+	if !f.Attributes.Active {
+		s.Confidence -= 10
+	}
+
+	if s.Confidence > 100 {
+		s.Confidence = 100
+	}
+	return s, s.Confidence > 0
+}
+
+func digits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// sameSuffix compares the last four digits, banks often only give those out
+func sameSuffix(a, b string) bool {
+	return len(a) >= 4 && len(b) >= 4 && a[len(a)-4:] == b[len(b)-4:]
+}
+
+// normaliseName lowercases a name and drops punctuation and filler words
+func normaliseName(name string) string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var kept []string
+	for _, f := range fields {
+		switch f {
+		case "account", "acct", "the", "my":
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return strings.Join(kept, " ")
+}
+
+// similarity is 1 minus the edit distance relative to the longer string
+func similarity(a, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"fidi/internal/basiq"
 	"fidi/internal/firefly"
@@ -15,127 +22,676 @@ import (
 type SyncManager struct {
 	Basiq   *basiq.Client
 	Firefly *firefly.Client
-	Storage *storage.DB // Assume this is available or passed
+	Storage storage.Store // Assume this is available or passed
 }
 
 // PerformSync runs the synchronization process
 // This function needs to be part of the Server struct or accessible
-func (s *Server) PerformSync() error {
+func (s *Server) PerformSync(ctx context.Context) error {
 	log.Println("Starting synchronization...")
 
 	// 1. Get Basiq User ID
+	userID, err := s.basiqUserID()
+	if err != nil {
+		return err
+	}
+
+	// 2. Get Mappings
+	mappings, err := s.mappingsFor(nil)
+	if err != nil {
+		return err
+	}
+
+	return s.syncMappings(ctx, userID, mappings)
+}
+
+func (s *Server) basiqUserID() (string, error) {
 	userID, err := s.db.GetKV("basiq_user_id")
 	if err != nil {
-		return fmt.Errorf("failed to get user id: %w", err)
+		return "", fmt.Errorf("failed to get user id: %w", err)
 	}
 	if userID == "" {
-		return fmt.Errorf("no basiq user connected")
+		return "", fmt.Errorf("no basiq user connected")
 	}
+	return userID, nil
+}
 
-	// 2. Get Mappings
-	mappings, err := s.db.GetMappings()
-	if err != nil {
-		return fmt.Errorf("failed to get mappings: %w", err)
+// limiter caps the number of concurrent operations, e.g. requests in
+// flight to one provider
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	if n < 1 {
+		n = 1
+	}
+	return make(limiter, n)
+}
+
+func (l limiter) acquire(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+func (l limiter) release() {
+	<-l
+}
+
+// importResult is the outcome of importing a batch of transactions
+type importResult struct {
+	Imported int
+	Skipped  int
+	Failed   int
+	// Cursor is the newest post date up to which every transaction is in
+	// Firefly, safe to use as the next "since"
+	Cursor string
+}
+
+// syncMappings imports transactions for the given mappings only.
+// Used by sync jobs, which may target a subset of the mapped accounts.
+// Accounts are synced in parallel, bounded by the account worker pool and
+// the per-provider request limits.
+func (s *Server) syncMappings(ctx context.Context, userID string, mappings []storage.AccountMapping) error {
 	if len(mappings) == 0 {
 		return fmt.Errorf("no accounts mapped")
 	}
 
 	// 3. Initialize Clients
-	// Re-init with latest keys if needed, but assuming config is static for now
-	// Or maybe keys are in DB? Plan said Env vars for keys.
-	// We use s.cfg
-	bClient := basiq.New(s.cfg.BasiqAPIKey)
-	fClient := firefly.New(s.cfg.FireflyURL, s.cfg.FireflyAccessToken)
+	// Credentials may have changed on the settings page since the last run
+	bClient := s.basiqClient()
+	fClient := s.fireflyClient()
 
-	totalImported := 0
+	started := time.Now()
+	tag := s.runTag(started)
+	runID, err := s.db.StartRun(len(mappings), tag)
+	if err != nil {
+		log.Printf("Failed to record sync run: %v", err)
+	}
+	s.events.publish(SyncEvent{Type: EventRunStarted, RunID: runID, Count: len(mappings)})
 
-	// 4. Iterate Mappings
+	names := make(map[string]string)
 	for _, m := range mappings {
-		log.Printf("Syncing account %s -> %s", m.BasiqAccountID, m.FireflyAccountID)
+		names[m.BasiqAccountID] = m.AccountName
+	}
+	bClient.OnPage = func(accountID string, page, count int) {
+		s.events.publish(SyncEvent{Type: EventPageFetched, RunID: runID, AccountID: accountID,
+			AccountName: names[accountID], Page: page, Count: count})
+	}
 
-		// Get last sync date for this account? Or global?
-		// Global for simplicity or per account.
-		// Let's rely on Firefly duplicate detection or use a short window (e.g. 7 days) if "since" is not stored.
-		// Ideally we store "last_sync_<basiq_account_id>".
-		lastSyncKey := "last_sync_" + m.BasiqAccountID
-		lastSyncVal, _ := s.db.GetKV(lastSyncKey)
+	if err := s.resolveAccountKinds(fClient, mappings); err != nil {
+		log.Printf("Treating unknown account types as asset accounts: %v", err)
+	}
 
-		var since string
-		if lastSyncVal != "" {
-			since = lastSyncVal
-		} else {
-			// Default to 30 days ago
-			since = time.Now().AddDate(0, 0, -30).Format("2006-01-02")
+	// 4. Sync mappings in parallel. Credit cards and liabilities go first,
+	// so repayments exist as transfers before the paying account is synced.
+	results := make([]storage.SyncRunAccount, len(mappings))
+	errs := make([]error, len(mappings))
+	pool := newLimiter(s.config().SyncAccountWorkers)
+	for _, liabilities := range []bool{true, false} {
+		var wg sync.WaitGroup
+		for i, m := range mappings {
+			isLiability := m.FireflyAccountKind == kindCreditCard || m.FireflyAccountKind == kindLiability
+			if isLiability != liabilities {
+				continue
+			}
+			if err := pool.acquire(ctx); err != nil {
+				break
+			}
+			wg.Add(1)
+			go func(i int, m storage.AccountMapping) {
+				defer wg.Done()
+				defer pool.release()
+				// Another job importing into the account covers it already
+				if !s.jobs.tryLockAccount(m.BasiqAccountID) {
+					log.Printf("Account %s is being synced by another job, skipping it", m.BasiqAccountID)
+					return
+				}
+				defer s.jobs.unlockAccount(m.BasiqAccountID)
+				results[i], errs[i] = s.syncAccount(ctx, bClient, fClient, userID, runID, m)
+			}(i, m)
 		}
+		wg.Wait()
+	}
 
-		txs, err := bClient.GetTransactions(userID, m.BasiqAccountID, since)
-		if err != nil {
-			log.Printf("Error fetching transactions for %s: %v", m.BasiqAccountID, err)
+	if ctx.Err() == nil {
+		s.checkBalances(ctx, bClient, fClient, userID, runID, mappings, results, errs)
+	}
+
+	run := storage.SyncRun{ID: runID, Status: storage.RunSuccess}
+	accountErrors := 0
+	var recorded []storage.SyncRunAccount
+	for i, res := range results {
+		if res.BasiqAccountID == "" {
+			// never started, cancelled before its turn
 			continue
 		}
+		res.RunID = runID
+		recorded = append(recorded, res)
+		run.Fetched += res.Fetched
+		run.Imported += res.Imported
+		run.Skipped += res.Skipped
+		run.Failed += res.Failed
+		if errs[i] != nil {
+			accountErrors++
+			log.Printf("Error syncing account %s: %v", res.BasiqAccountID, errs[i])
+		}
+	}
+	run.Duration = time.Since(started)
 
-		count := 0
-		newestDate := since
+	switch {
+	case ctx.Err() != nil:
+		run.Status = storage.RunFailed
+		run.Error = "cancelled"
+	case accountErrors == len(mappings):
+		run.Status = storage.RunFailed
+		run.Error = fmt.Sprintf("all %d accounts failed", accountErrors)
+	case accountErrors > 0 || run.Failed > 0:
+		run.Status = storage.RunPartial
+		run.Error = fmt.Sprintf("%d accounts failed, %d transactions failed", accountErrors, run.Failed)
+	}
+	if runID != 0 {
+		// One write for the whole run, so the history never shows a
+		// finished run with accounts missing
+		err := s.db.InTx(func(db storage.Store) error {
+			for _, res := range recorded {
+				if err := db.SaveRunAccount(res); err != nil {
+					return err
+				}
+			}
+			return db.FinishRun(run)
+		})
+		if err != nil {
+			log.Printf("Failed to record sync run: %v", err)
+		}
+	}
 
-		for _, tx := range txs {
-			// Convert Basiq Tx to Firefly Tx
-			amount, _ := strconv.ParseFloat(tx.Amount, 64)
-			// Basiq amount is negative for debit?
-			// Usually: Debit is negative, Credit is positive.
-			// Firefly: Withdrawal needs positive amount but type=withdrawal. Deposit needs positive amount type=deposit.
+	log.Printf("Sync finished in %s: %d imported, %d skipped, %d failed across %d accounts",
+		run.Duration.Round(time.Millisecond), run.Imported, run.Skipped, run.Failed, len(mappings))
+	s.events.publish(SyncEvent{Type: EventRunFinished, RunID: runID, Status: run.Status, Error: run.Error,
+		Imported: run.Imported, Skipped: run.Skipped, Failed: run.Failed})
 
-			ffTx := firefly.Transaction{
-				Description: tx.Description,
-				Date:        tx.PostDate, // ISO 8601
-				ExternalID:  tx.ID,
-			}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 
-			if amount < 0 {
-				ffTx.Type = "withdrawal"
-				ffTx.Amount = fmt.Sprintf("%.2f", math.Abs(amount))
-				ffTx.SourceID = m.FireflyAccountID
-			} else {
-				ffTx.Type = "deposit"
-				ffTx.Amount = fmt.Sprintf("%.2f", amount)
-				ffTx.DestinationID = m.FireflyAccountID
-			}
+	// Update global last run
+	s.db.SetKV("last_run", time.Now().Format(time.RFC3339))
+	switch run.Status {
+	case storage.RunFailed:
+		// Fail the job so it is retried
+		return errors.New(run.Error)
+	case storage.RunPartial:
+		s.db.SetKV("last_run_status", fmt.Sprintf("Partial: %d transactions, %s", run.Imported, run.Error))
+	default:
+		s.db.SetKV("last_run_status", fmt.Sprintf("Success: %d transactions", run.Imported))
+	}
 
-			if err := fClient.CreateTransaction(ffTx); err != nil {
-				log.Printf("Failed to import transaction %s: %v", tx.ID, err)
-			} else {
-				count++
+	return nil
+}
+
+// tagRun adds the tag of the run to a transaction it created. The tag is
+// left out of the transaction as posted, Firefly's duplicate detection
+// hashes all of it and would miss a transaction an earlier run imported.
+func (s *Server) tagRun(fClient *firefly.Client, runID int64, ffTx firefly.Transaction, created *firefly.CreatedTransaction) {
+	if runID == 0 || created.GroupID == "" {
+		return
+	}
+	run, err := s.db.GetRun(runID)
+	if err != nil || run == nil || run.Tag == "" {
+		return
+	}
+	tags := created.Tags
+	if tags == nil {
+		tags = ffTx.Tags
+	}
+	update := firefly.TransactionUpdate{JournalID: created.JournalID, Tags: append(slices.Clone(tags), run.Tag)}
+	if err := fClient.UpdateTransaction(created.GroupID, update); err != nil {
+		log.Printf("Failed to tag transaction %s with %s: %v", created.GroupID, run.Tag, err)
+	}
+}
+
+// runTag returns the tag for a run started at the given time
+func (s *Server) runTag(started time.Time) string {
+	return strings.ReplaceAll(s.config().RunTag, "{time}", started.In(s.location()).Format("2006-01-02T15:04"))
+}
+
+// syncSince returns the date after which the next sync of an account
+// imports transactions
+func (s *Server) syncSince(m storage.AccountMapping) string {
+	// Get last sync date for this account? Or global?
+	// Global for simplicity or per account.
+	// Let's rely on Firefly duplicate detection or use a short window (e.g. 7 days) if "since" is not stored.
+	// Ideally we store "last_sync_<basiq_account_id>".
+	since, _ := s.db.GetKV("last_sync_" + m.BasiqAccountID)
+	if since == "" {
+		// Default to 30 days ago
+		since = time.Now().AddDate(0, 0, -30).Format("2006-01-02")
+	}
+
+	// Never reach back past the mapping's start date
+	if start, err := dayBefore(m.StartDate); err == nil && start > since {
+		since = start
+	}
+	return since
+}
+
+// syncAccount imports everything since the account's last sync and
+// advances its cursor as far as is safe
+func (s *Server) syncAccount(ctx context.Context, bClient *basiq.Client, fClient *firefly.Client, userID string, runID int64, m storage.AccountMapping) (res storage.SyncRunAccount, err error) {
+	res = storage.SyncRunAccount{BasiqAccountID: m.BasiqAccountID, AccountName: m.AccountName}
+	log.Printf("Syncing account %s -> %s", m.BasiqAccountID, m.FireflyAccountID)
+	s.events.publish(SyncEvent{Type: EventAccountStarted, RunID: runID, AccountID: m.BasiqAccountID, AccountName: m.AccountName})
+	defer func() {
+		s.events.publish(SyncEvent{Type: EventAccountFinished, RunID: runID, AccountID: m.BasiqAccountID, AccountName: m.AccountName,
+			Imported: res.Imported, Skipped: res.Skipped, Failed: res.Failed, Error: res.Error})
+	}()
+
+	lastSyncKey := "last_sync_" + m.BasiqAccountID
+	since := s.syncSince(m)
+	res.Since = since
+	res.Cursor = since
+
+	// Give earlier failures another go before importing anything new
+	retried, stillFailing := s.retryDeadLetters(ctx, fClient, runID, m)
+	res.Imported += retried
+	res.Failed += stillFailing
+
+	fetchStart := time.Now()
+	if err := s.basiqLimit.acquire(ctx); err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+	window := s.overlapSince(m, since)
+	txs, err := bClient.GetTransactions(userID, m.BasiqAccountID, window)
+	s.basiqLimit.release()
+	res.FetchDuration = time.Since(fetchStart)
+	// What was fetched of a cut short list is imported, but can't tell
+	// what is gone and may miss older transactions the cursor would skip
+	truncated := errors.Is(err, basiq.ErrTruncated)
+	if truncated {
+		log.Printf("Account %s: %v, importing the %d fetched without moving the sync position or checking for vanished transactions",
+			m.BasiqAccountID, err, len(txs))
+	} else if err != nil {
+		res.Error = err.Error()
+		return res, fmt.Errorf("fetching transactions: %w", err)
+	}
+	res.Fetched = len(txs)
+
+	postStart := time.Now()
+	out, err := s.importTransactions(ctx, fClient, runID, m, txs, since)
+	res.PostDuration = time.Since(postStart)
+	res.Imported += out.Imported
+	res.Skipped += out.Skipped
+	res.Failed += out.Failed
+	res.Cursor = out.Cursor
+
+	log.Printf("Imported %d transactions for account %s (fetch %s, post %s)", out.Imported, m.BasiqAccountID,
+		res.FetchDuration.Round(time.Millisecond), res.PostDuration.Round(time.Millisecond))
+
+	// Only a complete fetch and import tells which transactions are gone
+	if err == nil && !truncated && s.fireflyLimit.acquire(ctx) == nil {
+		s.matchReversals(fClient, m, txs)
+		s.checkVanished(fClient, m, txs, window)
+		s.fireflyLimit.release()
+	}
+
+	// Update last sync. The cursor never moves past a transaction that
+	// failed, so this is safe even if we were interrupted.
+	if out.Cursor != since && !truncated {
+		s.db.SetKV(lastSyncKey, out.Cursor)
+	}
+	if truncated {
+		res.Cursor = since
+		if err == nil {
+			err = fmt.Errorf("fetching transactions: %w", basiq.ErrTruncated)
+		}
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res, err
+}
+
+// importTransactions posts the given Basiq transactions to Firefly in
+// parallel, bounded by the Firefly request limit
+func (s *Server) importTransactions(ctx context.Context, fClient *firefly.Client, runID int64, m storage.AccountMapping, txs []basiq.Transaction, since string) (importResult, error) {
+	// Oldest first, so the cursor can only advance over a fully imported prefix
+	var sorted []basiq.Transaction
+	for _, tx := range txs {
+		if m.PendingPolicy == storage.PendingSkip && strings.EqualFold(tx.Status, "pending") {
+			// picked up by a later sync once posted
+			continue
+		}
+		sorted = append(sorted, tx)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].PostDate < sorted[j].PostDate })
+
+	matcher := s.newMatcher(fClient, m, sorted)
+
+	errs := make([]error, len(sorted))
+	// Failures recorded in the dead-letter table are retried from there, so
+	// they don't have to hold the cursor back
+	parked := make([]bool, len(sorted))
+	var interrupted error
+	var wg sync.WaitGroup
+	for i, tx := range sorted {
+		if err := s.fireflyLimit.acquire(ctx); err != nil {
+			interrupted = err
+			for j := i; j < len(sorted); j++ {
+				errs[j] = err
+			}
+			break
+		}
+		wg.Add(1)
+		go func(i int, tx basiq.Transaction) {
+			defer wg.Done()
+			defer s.fireflyLimit.release()
+			ffTx := buildTransaction(m, tx)
+			imp, err := s.db.GetImported(tx.ID)
+			if err == nil && imp != nil {
+				// Seen before, only changes at the bank matter. A failed
+				// update is tried again while the transaction is in the
+				// overlap window, so it doesn't hold the cursor back.
+				err = s.reviseTransaction(fClient, tx, ffTx, imp)
+				parked[i] = true
+			} else if err == nil {
+				err = s.checkDeadLettered(tx.ID)
+			}
+			if err == nil && imp == nil {
+				// Entered by hand before the account was connected?
+				if err = s.linkExisting(fClient, matcher, m, tx, ffTx); errors.Is(err, errNoMatch) {
+					err = s.createTransaction(fClient, runID, m, tx, ffTx)
+				}
 			}
+			// A link that wasn't recorded is made again by the next sync,
+			// retrying it from the dead-letter table would create it instead
+			if err != nil && !isSkipped(err) && !parked[i] && !errors.Is(err, errLinkNotRecorded) {
+				if dlErr := s.deadLetter(m, tx, ffTx, err); dlErr != nil {
+					log.Printf("Failed to record failed transaction %s: %v", tx.ID, dlErr)
+				} else {
+					parked[i] = true
+				}
+			}
+			errs[i] = err
+			s.publishTransaction(runID, m, tx, err)
+		}(i, tx)
+	}
+	wg.Wait()
 
-			// Update newestDate if tx.PostDate > newestDate
-			if tx.PostDate > newestDate {
-				newestDate = tx.PostDate
+	res := importResult{Cursor: since}
+	firstFailure := -1
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			res.Imported++
+		case isSkipped(err):
+			res.Skipped++
+		default:
+			res.Failed++
+			if err != interrupted {
+				log.Printf("Failed to import transaction %s: %v", sorted[i].ID, err)
+			}
+			if firstFailure < 0 && !parked[i] {
+				firstFailure = i
 			}
 		}
+	}
 
-		log.Printf("Imported %d transactions for account %s", count, m.BasiqAccountID)
-		totalImported += count
+	// Advance to the newest date that has no unrecorded failure on or before it
+	end := len(sorted)
+	if firstFailure >= 0 {
+		end = firstFailure
+		for end > 0 && sorted[end-1].PostDate == sorted[firstFailure].PostDate {
+			end--
+		}
+	}
+	if end > 0 && sorted[end-1].PostDate > res.Cursor {
+		res.Cursor = sorted[end-1].PostDate
+	}
 
-		// Update last sync
-		s.db.SetKV(lastSyncKey, newestDate)
+	return res, interrupted
+}
+
+// recordImported remembers which Firefly transaction a Basiq transaction
+// became, so it can be found again later
+func recordImported(db storage.Store, runID int64, basiqAccountID string, tx basiq.Transaction, ffTx firefly.Transaction, created *firefly.CreatedTransaction) error {
+	if created.GroupID == "" {
+		return nil
 	}
+	return db.SaveImported(importedRecord(runID, basiqAccountID, tx, ffTx, created))
+}
 
-	// Update global last run
-	s.db.SetKV("last_run", time.Now().Format(time.RFC3339))
-	s.db.SetKV("last_run_status", fmt.Sprintf("Success: %d transactions", totalImported))
+// importedRecord is the ledger entry of a Basiq transaction that became
+// the given Firefly transaction
+func importedRecord(runID int64, basiqAccountID string, tx basiq.Transaction, ffTx firefly.Transaction, created *firefly.CreatedTransaction) storage.ImportedTransaction {
+	payload, _ := json.Marshal(ffTx)
+	return storage.ImportedTransaction{
+		BasiqTransactionID: tx.ID,
+		BasiqAccountID:     basiqAccountID,
+		FireflyGroupID:     created.GroupID,
+		FireflyJournalID:   created.JournalID,
+		PostDate:           ffTx.Date,
+		Amount:             ffTx.Amount,
+		RunID:              runID,
+		PayloadHash:        transactionHash(tx),
+		FireflyPayload:     string(payload),
+	}
+}
 
+// publishTransaction reports the outcome of importing one transaction
+func (s *Server) publishTransaction(runID int64, m storage.AccountMapping, tx basiq.Transaction, err error) {
+	e := SyncEvent{Type: EventTransactionImported, RunID: runID, AccountID: m.BasiqAccountID, AccountName: m.AccountName,
+		TransactionID: tx.ID, Description: tx.Description, Amount: tx.Amount, Date: tx.PostDate}
+	switch {
+	case isSkipped(err):
+		e.Type = EventTransactionSkipped
+	case err != nil:
+		e.Type = EventTransactionFailed
+		e.Error = err.Error()
+	}
+	s.events.publish(e)
+}
+
+func (s *Server) importTransaction(fClient *firefly.Client, m storage.AccountMapping, tx basiq.Transaction) error {
+	return s.createTransaction(fClient, 0, m, tx, buildTransaction(m, tx))
+}
+
+// Kinds of Firefly account a Basiq account can be mapped to. They decide
+// how the sign of a Basiq amount translates into a Firefly transaction.
+const (
+	kindAsset      = "asset"
+	kindCreditCard = "credit_card"
+	kindLiability  = "liability"
+)
+
+// accountKind classifies a Firefly account for sync purposes
+func accountKind(a firefly.Account) string {
+	switch {
+	case a.IsCreditCard():
+		return kindCreditCard
+	case a.IsLiability():
+		return kindLiability
+	}
+	return kindAsset
+}
+
+// resolveAccountKinds fills in the Firefly account kind of mappings created
+// before kinds were recorded
+func (s *Server) resolveAccountKinds(fClient *firefly.Client, mappings []storage.AccountMapping) error {
+	missing := false
+	for _, m := range mappings {
+		if m.FireflyAccountKind == "" {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	accounts, err := fClient.GetAccounts()
+	if err != nil {
+		return fmt.Errorf("failed to look up firefly account types: %w", err)
+	}
+	kinds := make(map[string]string)
+	for _, a := range accounts {
+		kinds[a.ID] = accountKind(a)
+	}
+
+	for i, m := range mappings {
+		if m.FireflyAccountKind != "" {
+			continue
+		}
+		kind, ok := kinds[m.FireflyAccountID]
+		if !ok {
+			continue
+		}
+		mappings[i].FireflyAccountKind = kind
+		if err := s.db.SetMappingKind(m.BasiqAccountID, kind); err != nil {
+			log.Printf("Failed to save account kind for %s: %v", m.BasiqAccountID, err)
+		}
+	}
 	return nil
 }
 
-func (s *Server) StartScheduler() {
-	ticker := time.NewTicker(24 * time.Hour)
-	go func() {
-		for range ticker.C {
-			log.Println("Running scheduled sync...")
-			if err := s.PerformSync(); err != nil {
-				log.Printf("Scheduled sync failed: %v", err)
-				s.db.SetKV("last_run_status", fmt.Sprintf("Failed: %v", err))
+// interestClasses and feeClasses are Basiq transaction classes booked as
+// expenses on credit cards and liabilities
+var (
+	interestClasses = map[string]bool{"interest": true, "loan-interest": true}
+	feeClasses      = map[string]bool{"bank-fee": true}
+)
+
+// buildTransaction converts a Basiq transaction into the Firefly
+// transaction we create for it
+func buildTransaction(m storage.AccountMapping, tx basiq.Transaction) firefly.Transaction {
+	// Convert Basiq Tx to Firefly Tx
+	amount, _ := strconv.ParseFloat(tx.Amount, 64)
+	if m.InvertSign {
+		amount = -amount
+	}
+	// Basiq amount is negative for debit?
+	// Usually: Debit is negative, Credit is positive.
+	// Firefly: Withdrawal needs positive amount but type=withdrawal. Deposit needs positive amount type=deposit.
+
+	ffTx := firefly.Transaction{
+		Description: tx.Description,
+		Date:        tx.PostDate, // ISO 8601
+		Amount:      fmt.Sprintf("%.2f", math.Abs(amount)),
+		ExternalID:  tx.ID,
+		Tags:        m.TagList(),
+	}
+
+	if m.FireflyAccountKind == kindCreditCard || m.FireflyAccountKind == kindLiability {
+		buildLiabilityTransaction(&ffTx, m, tx, amount)
+	} else if amount < 0 {
+		ffTx.Type = "withdrawal"
+		ffTx.SourceID = m.FireflyAccountID
+	} else {
+		ffTx.Type = "deposit"
+		ffTx.DestinationID = m.FireflyAccountID
+	}
+
+	if ffTx.CategoryName == "" {
+		ffTx.CategoryName = m.Category
+	}
+	return ffTx
+}
+
+// buildLiabilityTransaction handles credit cards, loans and mortgages,
+// where a debit increases what is owed and a credit pays it off.
+//
+//   - purchases, redraws, interest and fees are withdrawals from the card
+//     or liability (interest and fees to a dedicated expense account)
+//   - repayments are transfers from the paying asset account, or deposits
+//     if no paying account is configured
+//   - refunds are deposits into the card or liability
+func buildLiabilityTransaction(ffTx *firefly.Transaction, m storage.AccountMapping, tx basiq.Transaction, amount float64) {
+	class := strings.ToLower(tx.Class)
+
+	if amount < 0 {
+		ffTx.Type = "withdrawal"
+		ffTx.SourceID = m.FireflyAccountID
+		switch {
+		case interestClasses[class]:
+			ffTx.DestinationName = "Interest"
+			ffTx.CategoryName = "Interest"
+		case feeClasses[class]:
+			ffTx.DestinationName = "Bank fees"
+			ffTx.CategoryName = "Bank fees"
+		}
+		return
+	}
+
+	if class != "refund" && m.PaymentAccountID != "" {
+		ffTx.Type = "transfer"
+		ffTx.SourceID = m.PaymentAccountID
+		ffTx.DestinationID = m.FireflyAccountID
+		return
+	}
+
+	ffTx.Type = "deposit"
+	ffTx.DestinationID = m.FireflyAccountID
+}
+
+// errRepaymentLeg marks a debit on a paying account that is the other
+// side of a repayment transfer we already created
+var errRepaymentLeg = errors.New("already imported as a repayment transfer")
+
+// repaymentWindowDays is how far apart the two sides of a repayment may be
+// posted by the banks
+const repaymentWindowDays = 3
+
+// isSkipped reports whether an import error means there was nothing to do
+func isSkipped(err error) bool {
+	return errors.Is(err, firefly.ErrDuplicate) || errors.Is(err, errRepaymentLeg) ||
+		errors.Is(err, errUnchanged) || errors.Is(err, errChangeFlagged) ||
+		errors.Is(err, errLinked) || errors.Is(err, errMatchFlagged) ||
+		errors.Is(err, errDeadLettered) || errors.Is(err, errDismissed)
+}
+
+// createTransaction posts a transaction to Firefly, taking care of both
+// sides of credit card and loan repayments
+func (s *Server) createTransaction(fClient *firefly.Client, runID int64, m storage.AccountMapping, tx basiq.Transaction, ffTx firefly.Transaction) error {
+	// A debit on a paying account may be a repayment we already created as
+	// a transfer from the card side
+	if ffTx.Type == "withdrawal" && m.FireflyAccountKind != kindCreditCard && m.FireflyAccountKind != kindLiability {
+		isPayer, err := s.db.IsPaymentAccount(m.FireflyAccountID)
+		if err != nil {
+			return err
+		}
+		if isPayer {
+			claimed, err := s.db.ClaimRepaymentLeg(m.FireflyAccountID, ffTx.Amount, ffTx.Date, tx.ID, repaymentWindowDays)
+			if err != nil {
+				return err
+			}
+			if claimed {
+				return errRepaymentLeg
 			}
 		}
-	}()
+	}
+
+	created, err := fClient.CreateTransaction(ffTx)
+	if err != nil {
+		return err
+	}
+
+	// The ledger and the repayment leg are written together, a repayment
+	// without its ledger entry would be claimed but never rolled back
+	err = s.db.InTx(func(db storage.Store) error {
+		if err := recordImported(db, runID, m.BasiqAccountID, tx, ffTx, created); err != nil {
+			return err
+		}
+		if ffTx.Type == "transfer" {
+			return db.SaveRepaymentLeg(ffTx.SourceID, ffTx.Amount, ffTx.Date, tx.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to record imported transaction %s: %v", tx.ID, err)
+	}
+	s.tagRun(fClient, runID, ffTx, created)
+	return nil
 }
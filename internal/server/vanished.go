@@ -0,0 +1,268 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"fidi/internal/basiq"
+	"fidi/internal/firefly"
+	"fidi/internal/storage"
+)
+
+// What happens to imported transactions that vanished from Basiq or were
+// reversed, anything else holds them for review
+const (
+	vanishedTag    = "tag"
+	vanishedDelete = "delete"
+)
+
+// reversedTag marks Firefly transactions that were cancelled at the bank
+const reversedTag = "reversed"
+
+// reversalWindowDays is how long after a transaction its reversal may be posted
+const reversalWindowDays = 30
+
+// vanishedAfterSyncs is how many syncs in a row must miss a transaction
+// before it counts as vanished, Basiq sometimes leaves one out of a single
+// answer
+const vanishedAfterSyncs = 2
+
+// reversalPattern matches the descriptions banks give reversals
+var reversalPattern = regexp.MustCompile(`(?i)\b(reversal|reversed|reverse)\b`)
+
+// checkVanished looks for imported transactions in the overlap window that
+// Basiq no longer returns, e.g. pending holds that were cancelled or came
+// back posted under a new ID
+func (s *Server) checkVanished(fClient *firefly.Client, m storage.AccountMapping, txs []basiq.Transaction, window string) {
+	if len(txs) == 0 {
+		// An empty answer is more likely a hiccup at Basiq than every
+		// transaction disappearing
+		return
+	}
+	t, err := time.Parse("2006-01-02", window[:min(len(window), 10)])
+	if err != nil {
+		return
+	}
+	// Basiq returns transactions posted after the window start, a
+	// transaction on that day may or may not be included
+	from := t.AddDate(0, 0, 1).Format("2006-01-02")
+
+	imported, err := s.db.GetImportedSince(m.BasiqAccountID, from)
+	if err != nil {
+		log.Printf("Failed to load imported transactions of %s: %v", m.BasiqAccountID, err)
+		return
+	}
+	present := make(map[string]bool, len(txs))
+	for _, tx := range txs {
+		present[tx.ID] = true
+	}
+
+	for _, imp := range imported {
+		if present[imp.BasiqTransactionID] {
+			if imp.State == storage.ImportReview && imp.Counterpart == "" {
+				// Came back before anyone looked at it
+				s.db.SetImportedState(imp.BasiqTransactionID, "", "")
+			}
+			if imp.Missed > 0 {
+				s.db.SetImportedMissed(imp.BasiqTransactionID, 0)
+			}
+			continue
+		}
+		if imp.State != "" || imp.FireflyGroupID == "" {
+			continue
+		}
+		if imp.Missed+1 < vanishedAfterSyncs {
+			log.Printf("Transaction %s (%s) is not returned by Basiq, checking again next sync", imp.BasiqTransactionID, imp.PostDate)
+			if err := s.db.SetImportedMissed(imp.BasiqTransactionID, imp.Missed+1); err != nil {
+				log.Printf("Failed to record missing transaction %s: %v", imp.BasiqTransactionID, err)
+			}
+			continue
+		}
+		log.Printf("Transaction %s (%s) is no longer returned by Basiq", imp.BasiqTransactionID, imp.PostDate)
+		if err := s.resolveVanished(fClient, &imp, s.vanishedAction(&imp)); err != nil {
+			log.Printf("Failed to handle vanished transaction %s: %v", imp.BasiqTransactionID, err)
+		}
+	}
+}
+
+// vanishedAction is what happens to a vanished or reversed transaction
+// without asking. Transactions the importer only linked were entered by
+// hand and are never deleted, they are held for review instead.
+func (s *Server) vanishedAction(affected ...*storage.ImportedTransaction) string {
+	action := s.config().VanishedTransactions
+	if action != vanishedDelete {
+		return action
+	}
+	for _, t := range affected {
+		if t.Linked {
+			log.Printf("Transaction %s was entered by hand, holding it for review instead of deleting it", t.BasiqTransactionID)
+			return storage.ImportReview
+		}
+	}
+	return action
+}
+
+// matchReversals finds Basiq transactions that reverse an earlier imported
+// one and deals with the pair
+func (s *Server) matchReversals(fClient *firefly.Client, m storage.AccountMapping, txs []basiq.Transaction) {
+	for _, tx := range txs {
+		if !reversalPattern.MatchString(tx.Description) {
+			continue
+		}
+		rev, err := s.db.GetImported(tx.ID)
+		if err != nil || rev == nil || rev.State != "" || rev.FireflyGroupID == "" {
+			continue
+		}
+		orig := s.reversedOriginal(m, rev, tx.Description)
+		if orig == nil {
+			continue
+		}
+
+		log.Printf("Transaction %s reverses %s", tx.ID, orig.BasiqTransactionID)
+		if err := s.db.SetImportedState(rev.BasiqTransactionID, storage.ImportReversal, orig.BasiqTransactionID); err != nil {
+			log.Printf("Failed to link reversal %s: %v", tx.ID, err)
+			continue
+		}
+		orig.Counterpart = rev.BasiqTransactionID
+		if err := s.resolveVanished(fClient, orig, s.vanishedAction(orig, rev)); err != nil {
+			// The pair won't be matched again, leave it to the user
+			log.Printf("Failed to handle reversal %s, holding it for review: %v", tx.ID, err)
+			s.db.SetImportedState(orig.BasiqTransactionID, storage.ImportReview, rev.BasiqTransactionID)
+		}
+	}
+}
+
+// reversedOriginal picks the imported transaction a reversal cancels: same
+// amount in the other direction, posted no later and not long before, with
+// the most similar description
+func (s *Server) reversedOriginal(m storage.AccountMapping, rev *storage.ImportedTransaction, description string) *storage.ImportedTransaction {
+	t, err := time.Parse("2006-01-02", rev.PostDate[:min(len(rev.PostDate), 10)])
+	if err != nil {
+		return nil
+	}
+	candidates, err := s.db.GetImportedSince(m.BasiqAccountID, t.AddDate(0, 0, -reversalWindowDays).Format("2006-01-02"))
+	if err != nil {
+		return nil
+	}
+	var revTx firefly.Transaction
+	json.Unmarshal([]byte(rev.FireflyPayload), &revTx)
+	name := normaliseName(reversalPattern.ReplaceAllString(description, ""))
+
+	var best *storage.ImportedTransaction
+	bestScore := -1.0
+	for i, c := range candidates {
+		if c.BasiqTransactionID == rev.BasiqTransactionID || c.State != "" || c.FireflyGroupID == "" ||
+			c.PostDate > rev.PostDate || !sameAmount(c.Amount, rev.Amount) {
+			continue
+		}
+		var cTx firefly.Transaction
+		json.Unmarshal([]byte(c.FireflyPayload), &cTx)
+		if cTx.Type == revTx.Type {
+			continue
+		}
+		// Later candidates win ties, candidates are ordered by date
+		if score := similarity(name, normaliseName(cTx.Description)); score >= bestScore {
+			best, bestScore = &candidates[i], score
+		}
+	}
+	return best
+}
+
+// resolveVanished deletes, tags or holds for review a transaction that
+// vanished or was reversed. For a reversal both sides are dealt with.
+func (s *Server) resolveVanished(fClient *firefly.Client, imp *storage.ImportedTransaction, action string) error {
+	affected := []*storage.ImportedTransaction{imp}
+	if imp.Counterpart != "" {
+		other, err := s.db.GetImported(imp.Counterpart)
+		if err != nil {
+			return err
+		}
+		if other != nil {
+			affected = append(affected, other)
+		}
+	}
+
+	state := storage.ImportReview
+	for _, t := range affected {
+		var err error
+		switch action {
+		case vanishedDelete:
+			state = storage.ImportDeleted
+			err = fClient.DeleteTransaction(t.FireflyGroupID)
+		case vanishedTag:
+			state = storage.ImportReversed
+			err = s.tagReversed(fClient, t)
+		case storage.ImportKept:
+			state = storage.ImportKept
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := s.db.SetImportedState(imp.BasiqTransactionID, state, imp.Counterpart); err != nil {
+		return err
+	}
+	if len(affected) > 1 && state != storage.ImportReview && state != storage.ImportKept {
+		return s.db.SetImportedState(imp.Counterpart, state, imp.BasiqTransactionID)
+	}
+	return nil
+}
+
+// tagReversed adds the reversed tag to a Firefly transaction, keeping its
+// other tags
+func (s *Server) tagReversed(fClient *firefly.Client, imp *storage.ImportedTransaction) error {
+	current, err := fClient.GetTransaction(imp.FireflyGroupID)
+	if err != nil || current == nil {
+		return err
+	}
+	for _, tag := range current.Tags {
+		if strings.EqualFold(tag, reversedTag) {
+			return nil
+		}
+	}
+	return fClient.UpdateTransaction(imp.FireflyGroupID, firefly.TransactionUpdate{
+		JournalID: imp.FireflyJournalID,
+		Tags:      append(current.Tags, reversedTag),
+	})
+}
+
+// vanishedTransaction is a vanished or reversed transaction as shown on
+// the review page
+type vanishedTransaction struct {
+	storage.ImportedTransaction
+	AccountName string
+	Sent        firefly.Transaction
+	// Reversal is the transaction that cancelled this one, if any
+	Reversal *firefly.Transaction
+}
+
+// vanishedForReview loads the vanished and reversed transactions waiting
+// for a decision
+func (s *Server) vanishedForReview() ([]vanishedTransaction, error) {
+	imported, err := s.db.GetVanishedForReview()
+	if err != nil {
+		return nil, err
+	}
+	names, err := s.accountNames()
+	if err != nil {
+		return nil, err
+	}
+
+	vanished := make([]vanishedTransaction, 0, len(imported))
+	for _, imp := range imported {
+		v := vanishedTransaction{ImportedTransaction: imp, AccountName: names[imp.BasiqAccountID]}
+		json.Unmarshal([]byte(imp.FireflyPayload), &v.Sent)
+		if imp.Counterpart != "" {
+			if other, err := s.db.GetImported(imp.Counterpart); err == nil && other != nil {
+				v.Reversal = &firefly.Transaction{}
+				json.Unmarshal([]byte(other.FireflyPayload), v.Reversal)
+			}
+		}
+		vanished = append(vanished, v)
+	}
+	return vanished, nil
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveVersion is the format of exported archives. Bump it when older
+// releases could no longer read an archive correctly.
+const ArchiveVersion = 1
+
+// Archive is everything needed to move the importer to another host: the
+// settings (Basiq user, cursors, schedules), the account mappings with their
+// rules, and the ledger of imported transactions. Sync history and jobs are
+// left behind.
+type Archive struct {
+	Version       int                   `json:"version"`
+	SchemaVersion int                   `json:"schema_version"`
+	ExportedAt    time.Time             `json:"exported_at"`
+	Settings      map[string]string     `json:"settings"`
+	Mappings      []AccountMapping      `json:"mappings"`
+	Imported      []ImportedTransaction `json:"imported"`
+	RepaymentLegs []RepaymentLeg        `json:"repayment_legs"`
+}
+
+// RepaymentLeg is a repayment transfer created from the credit card or
+// liability side, see SaveRepaymentLeg
+type RepaymentLeg struct {
+	PaymentAccountID   string
+	Amount             string
+	Date               string
+	BasiqTransactionID string
+	ClaimedBy          string
+}
+
+// RestoreReport counts what a restore wrote, and names what it left alone
+// because it was already here
+type RestoreReport struct {
+	Settings      int
+	Mappings      int
+	Imported      int
+	RepaymentLegs int
+
+	// Setting keys, and Basiq transaction IDs of ledger rows
+	KeptSettings      []string
+	KeptImported      []string
+	KeptRepaymentLegs []string
+	// Notes explain settings of the export that were left out
+	Notes []string
+}
+
+// Where the settings page keeps the Firefly URL and token. A token is only
+// ever used with the URL it was entered for.
+const (
+	fireflyURLKey   = "setting_firefly_iii_url"
+	fireflyTokenKey = "setting_firefly_iii_access_token"
+)
+
+// credentialKey tells whether a setting is a credential, which exports
+// leave out unless asked for. The Basiq user ID is sensitive too, but an
+// export is of no use without it.
+func credentialKey(key string) bool {
+	return sensitiveKey(key) && key != "basiq_user_id" && key != legacyImportKey
+}
+
+// keptShown is how many of the kept entries Kept names, the rest are counted
+const keptShown = 10
+
+// Kept describes what was already here and kept, one line per kind
+func (r *RestoreReport) Kept() []string {
+	var lines []string
+	for _, kind := range []struct {
+		name string
+		ids  []string
+	}{
+		{"settings", r.KeptSettings},
+		{"imported transactions", r.KeptImported},
+		{"repayments", r.KeptRepaymentLegs},
+	} {
+		if len(kind.ids) == 0 {
+			continue
+		}
+		shown := kind.ids
+		if len(shown) > keptShown {
+			shown = shown[:keptShown]
+		}
+		line := fmt.Sprintf("Kept %d %s already here: %s", len(kind.ids), kind.name, strings.Join(shown, ", "))
+		if more := len(kind.ids) - len(shown); more > 0 {
+			line += fmt.Sprintf(" and %d more", more)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Export collects the archive. Credentials saved on the settings page are
+// left out unless credentials is set. Encrypted values are decrypted, so
+// treat the archive like a password.
+func (d *DB) Export(credentials bool) (*Archive, error) {
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{Version: ArchiveVersion, SchemaVersion: version, ExportedAt: time.Now().UTC(), Settings: make(map[string]string)}
+
+	rows, err := d.query("SELECT key FROM kv_store ORDER BY key")
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if credentials || !credentialKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if a.Settings[key], err = d.GetKV(key); err != nil {
+			return nil, fmt.Errorf("setting %s: %w", key, err)
+		}
+	}
+
+	if a.Mappings, err = d.GetMappings(); err != nil {
+		return nil, err
+	}
+	if a.Imported, err = d.queryImported("SELECT " + importedColumns + " FROM imported_transactions ORDER BY post_date, basiq_transaction_id"); err != nil {
+		return nil, err
+	}
+
+	rows, err = d.query("SELECT payment_account_id, amount, date, basiq_transaction_id, claimed_by FROM repayment_legs ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l RepaymentLeg
+		if err := rows.Scan(&l.PaymentAccountID, &l.Amount, &l.Date, &l.BasiqTransactionID, &l.ClaimedBy); err != nil {
+			return nil, err
+		}
+		a.RepaymentLegs = append(a.RepaymentLegs, l)
+	}
+	return a, rows.Err()
+}
+
+// Restore writes an archive into the database in one transaction. Settings
+// and ledger entries already here are kept unless overwrite is set.
+// Mappings that differ from the ones here are never replaced silently: the
+// restore fails unless overwrite is set.
+func (d *DB) Restore(a *Archive, overwrite bool) (*RestoreReport, error) {
+	if a.Version == 0 {
+		return nil, fmt.Errorf("not an importer export")
+	}
+	if a.Version > ArchiveVersion {
+		return nil, fmt.Errorf("export format %d is newer than this release supports (%d)", a.Version, ArchiveVersion)
+	}
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if a.SchemaVersion > current {
+		return nil, fmt.Errorf("export was made with database schema %d, newer than this release (%d), upgrade first", a.SchemaVersion, current)
+	}
+
+	report := &RestoreReport{}
+	err = d.InTx(func(s Store) error {
+		tx := s.(*DB)
+		// Checked in the transaction, so a mapping saved meanwhile can't
+		// be replaced after all
+		if !overwrite {
+			var conflicts []string
+			for _, m := range a.Mappings {
+				existing, err := tx.GetMappingByBasiqID(m.BasiqAccountID)
+				if err != nil {
+					return err
+				}
+				m.ID = 0
+				if existing != nil {
+					existing.ID = 0
+					if *existing != m {
+						conflicts = append(conflicts, m.AccountName)
+					}
+				}
+			}
+			if len(conflicts) > 0 {
+				return fmt.Errorf("%d account mapping(s) already exist with other settings (%s), restore with overwrite to replace them",
+					len(conflicts), strings.Join(conflicts, ", "))
+			}
+		}
+
+		// Without overwrite rows already here win
+		conflict := "DO NOTHING"
+		if overwrite {
+			conflict = "DO UPDATE SET value = excluded.value"
+		}
+		keys := make([]string, 0, len(a.Settings))
+		for key := range a.Settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := a.Settings[key]
+			if key == fireflyURLKey && a.Settings[fireflyTokenKey] == "" {
+				// The token here would be sent to the URL of the export
+				current, err := tx.GetKV(key)
+				if err != nil {
+					return err
+				}
+				if current != value {
+					report.Notes = append(report.Notes, fmt.Sprintf("Left out the Firefly III URL %s, the export has no access token for it. Set both on the settings page.", value))
+					continue
+				}
+			}
+			if sensitiveKey(key) {
+				sealed, err := tx.keys.seal(value)
+				if err != nil {
+					return err
+				}
+				value = sealed
+			}
+			res, err := tx.exec("INSERT INTO kv_store (key, value) VALUES (?, ?) ON CONFLICT(key) "+conflict, key, value)
+			if err != nil {
+				return fmt.Errorf("setting %s: %w", key, err)
+			}
+			if affected(res) == 0 {
+				report.KeptSettings = append(report.KeptSettings, key)
+				continue
+			}
+			report.Settings++
+		}
+
+		for _, m := range a.Mappings {
+			if err := tx.SaveMapping(m); err != nil {
+				return fmt.Errorf("mapping %s: %w", m.BasiqAccountID, err)
+			}
+			report.Mappings++
+		}
+
+		for _, t := range a.Imported {
+			if overwrite {
+				if err := tx.DeleteImported(t.BasiqTransactionID); err != nil {
+					return err
+				}
+			}
+			payload, err := tx.keys.seal(t.FireflyPayload)
+			if err != nil {
+				return err
+			}
+			pending, err := tx.keys.seal(t.PendingPayload)
+			if err != nil {
+				return err
+			}
+			res, err := tx.exec(`INSERT INTO imported_transactions (`+importedColumns+`)
+			          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(basiq_transaction_id) DO NOTHING`,
+				t.BasiqTransactionID, t.BasiqAccountID, t.FireflyGroupID, t.FireflyJournalID, t.PostDate, t.Amount,
+				boolInt(t.Reconciled), t.RunID, t.PayloadHash, payload, t.PendingHash, pending,
+				t.State, t.Counterpart, boolInt(t.Linked), t.Missed, t.CreatedAt.Unix())
+			if err != nil {
+				return fmt.Errorf("imported transaction %s: %w", t.BasiqTransactionID, err)
+			}
+			if affected(res) == 0 {
+				report.KeptImported = append(report.KeptImported, t.BasiqTransactionID)
+				continue
+			}
+			report.Imported++
+		}
+
+		for _, l := range a.RepaymentLegs {
+			if overwrite {
+				if err := tx.DeleteRepaymentLeg(l.BasiqTransactionID); err != nil {
+					return err
+				}
+			}
+			res, err := tx.exec(`INSERT INTO repayment_legs (payment_account_id, amount, date, basiq_transaction_id, claimed_by)
+			          VALUES (?, ?, ?, ?, ?) ON CONFLICT(basiq_transaction_id) DO NOTHING`,
+				l.PaymentAccountID, l.Amount, l.Date, l.BasiqTransactionID, l.ClaimedBy)
+			if err != nil {
+				return fmt.Errorf("repayment %s: %w", l.BasiqTransactionID, err)
+			}
+			if affected(res) == 0 {
+				report.KeptRepaymentLegs = append(report.KeptRepaymentLegs, l.BasiqTransactionID)
+				continue
+			}
+			report.RepaymentLegs++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func affected(res sql.Result) int {
+	n, _ := res.RowsAffected()
+	return int(n)
+}
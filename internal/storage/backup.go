@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups are named after when they were taken, so they sort oldest first
+const (
+	backupPrefix = "fidi-"
+	backupSuffix = ".sqlite"
+	backupLayout = "20060102-150405"
+)
+
+// BackupFile is a backup in the backup directory
+type BackupFile struct {
+	Name    string
+	Size    int64
+	TakenAt time.Time
+}
+
+// BackupTo writes a consistent copy of the database into dir while it is
+// in use, then removes all but the newest keep backups there. keep 0 keeps
+// everything.
+func (d *DB) BackupTo(dir string, keep int) (string, error) {
+	if d.dialect.name != DriverSQLite {
+		return "", errors.New("backups are only taken of SQLite, use pg_dump for PostgreSQL")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, backupPrefix+time.Now().Format(backupLayout)+backupSuffix)
+	if _, err := os.Stat(file); err == nil {
+		return "", fmt.Errorf("backup %s already exists", file)
+	}
+	if _, err := d.Conn.Exec("VACUUM INTO ?", file); err != nil {
+		return "", err
+	}
+	log.Printf("Backed up the database to %s", file)
+
+	if keep <= 0 {
+		return file, nil
+	}
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return file, err
+	}
+	for i := 0; i < len(backups)-keep; i++ {
+		if err := os.Remove(filepath.Join(dir, backups[i].Name)); err != nil {
+			return file, err
+		}
+		log.Printf("Removed old backup %s", backups[i].Name)
+	}
+	return file, nil
+}
+
+// ListBackups returns the backups in dir, oldest first
+func ListBackups(dir string) ([]BackupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		taken, err := time.ParseInLocation(backupLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix), time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, BackupFile{Name: name, Size: info.Size(), TakenAt: taken})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+	return backups, nil
+}
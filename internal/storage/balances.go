@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+)
+
+// BalanceCheck is the latest comparison of an account's balance at Basiq
+// and in Firefly. Drift is Basiq minus Firefly.
+type BalanceCheck struct {
+	BasiqAccountID string
+	BasiqBalance   string
+	FireflyBalance string
+	Drift          string
+	CheckedAt      time.Time
+}
+
+// HasDrift reports whether the balances didn't match
+func (b BalanceCheck) HasDrift() bool {
+	return hasDrift(b.Drift)
+}
+
+func hasDrift(drift string) bool {
+	d, err := strconv.ParseFloat(drift, 64)
+	return err == nil && (d >= 0.005 || d <= -0.005)
+}
+
+// SaveBalanceCheck stores the latest balance comparison of an account
+func (d *DB) SaveBalanceCheck(b BalanceCheck) error {
+	_, err := d.exec(`INSERT INTO balance_checks (basiq_account_id, basiq_balance, firefly_balance, drift, checked_at)
+	          VALUES (?, ?, ?, ?, ?)
+	          ON CONFLICT(basiq_account_id) DO UPDATE SET
+	          basiq_balance = excluded.basiq_balance,
+	          firefly_balance = excluded.firefly_balance,
+	          drift = excluded.drift,
+	          checked_at = excluded.checked_at`,
+		b.BasiqAccountID, b.BasiqBalance, b.FireflyBalance, b.Drift, time.Now().Unix())
+	return err
+}
+
+// GetBalanceChecks returns the latest balance comparison of every account,
+// keyed by Basiq account ID
+func (d *DB) GetBalanceChecks() (map[string]BalanceCheck, error) {
+	rows, err := d.query("SELECT basiq_account_id, basiq_balance, firefly_balance, drift, checked_at FROM balance_checks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := make(map[string]BalanceCheck)
+	for rows.Next() {
+		var b BalanceCheck
+		var checkedAt int64
+		if err := rows.Scan(&b.BasiqAccountID, &b.BasiqBalance, &b.FireflyBalance, &b.Drift, &checkedAt); err != nil {
+			return nil, err
+		}
+		b.CheckedAt = time.Unix(checkedAt, 0)
+		checks[b.BasiqAccountID] = b
+	}
+	return checks, rows.Err()
+}
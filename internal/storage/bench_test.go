@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ledgerRows is the size of a large sync run
+const ledgerRows = 10000
+
+func insertLedger(db Store, run int, rows int) error {
+	return db.InTx(func(s Store) error {
+		for i := 0; i < rows; i++ {
+			err := s.SaveImported(ImportedTransaction{
+				BasiqTransactionID: fmt.Sprintf("run%d-tx%d", run, i), BasiqAccountID: "acc",
+				FireflyGroupID: "1", FireflyJournalID: "1", PostDate: "2024-03-01", Amount: "-1.00",
+				PayloadHash: "hash", FireflyPayload: `{"description":"coffee"}`,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BenchmarkSaveImported records a run of 10k imported transactions in one
+// transaction on a WAL file database
+func BenchmarkSaveImported(b *testing.B) {
+	db := newSQLiteStore(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := insertLedger(db, n, ledgerRows); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(ledgerRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// BenchmarkSaveImportedWhileLeasing records 10k imported transactions while
+// two workers keep queueing and leasing jobs, as they do during a sync. It
+// compares the connection settings in use with deferred transactions and
+// with no busy timeout, counting the writes that failed on a locked
+// database.
+func BenchmarkSaveImportedWhileLeasing(b *testing.B) {
+	for _, bc := range []struct{ name, params string }{
+		{"immediate", sqliteParams},
+		{"deferred", "_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)&_pragma=synchronous(NORMAL)&_txlock=deferred"},
+		{"no-busy-timeout", "_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			db := openSQLiteWith(b, bc.params)
+			var failed, leased atomic.Int64
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				stop := make(chan struct{})
+				var wg sync.WaitGroup
+				for w := 0; w < 2; w++ {
+					owner := fmt.Sprintf("w%d", w)
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; ; i++ {
+							select {
+							case <-stop:
+								return
+							default:
+							}
+							if _, err := db.EnqueueJob(JobSyncAccount, fmt.Sprintf(`{"%s":%d}`, owner, i), time.Now(), 1); err != nil {
+								failed.Add(1)
+								continue
+							}
+							job, err := db.LeaseJob(owner, time.Minute)
+							if err != nil {
+								failed.Add(1)
+								continue
+							}
+							if job != nil {
+								leased.Add(1)
+								if err := db.CompleteJob(job.ID); err != nil {
+									failed.Add(1)
+								}
+							}
+						}
+					}()
+				}
+				if err := insertLedger(db, n, ledgerRows); err != nil {
+					failed.Add(1)
+				}
+				close(stop)
+				wg.Wait()
+			}
+			b.ReportMetric(float64(failed.Load())/float64(b.N), "failed/op")
+			b.ReportMetric(float64(leased.Load())/float64(b.N), "leased/op")
+		})
+	}
+}
+
+// openSQLiteWith opens a file database with other connection settings than
+// New uses
+func openSQLiteWith(b *testing.B, params string) *DB {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "fidi.sqlite")
+	conn, err := sql.Open("sqlite", path+"?"+params)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn.SetMaxOpenConns(sqliteConns)
+	b.Cleanup(func() { conn.Close() })
+	db := &DB{Conn: conn, dialect: sqliteDialect}
+	if err := db.migrate(path, Options{}); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// BenchmarkReadThenWrite runs transactions that read before they write, like
+// Restore and the retry of failed transactions, four at a time. Deferred
+// transactions that both read can't both upgrade to a write lock, and the
+// busy timeout doesn't help with that, one of them fails.
+func BenchmarkReadThenWrite(b *testing.B) {
+	for _, bc := range []struct{ name, params string }{
+		{"immediate", sqliteParams},
+		{"deferred", "_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)&_pragma=synchronous(NORMAL)&_txlock=deferred"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			db := openSQLiteWith(b, bc.params)
+			var failed atomic.Int64
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				var wg sync.WaitGroup
+				for w := 0; w < 4; w++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < 25; i++ {
+							err := db.InTx(func(s Store) error {
+								v, err := s.GetKV("counter")
+								if err != nil {
+									return err
+								}
+								// Let the others read meanwhile
+								time.Sleep(time.Millisecond)
+								return s.SetKV("counter", v+"x")
+							})
+							if err != nil {
+								failed.Add(1)
+							}
+						}
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(failed.Load())/float64(b.N), "failed/op")
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sealedPrefix marks an encrypted value: enc:v1:<key id>:<base64 envelope>
+const sealedPrefix = "enc:v1:"
+
+// errNoKey means a value is encrypted but no key was configured
+var errNoKey = errors.New("value is encrypted but DB_ENCRYPTION_KEY is not set")
+
+// Keyring holds the keys values are encrypted with. The first key encrypts,
+// the others only decrypt, until a rotation moves everything to the first.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring reads comma separated 256-bit keys, base64 encoded, each
+// optionally prefixed by an ID and a colon. Without an ID one is derived
+// from the key. An empty spec means no encryption.
+func ParseKeyring(spec string) (*Keyring, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for i, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found {
+			id, encoded = "", entry
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %d must be 32 bytes, base64 encoded", i+1)
+		}
+		if id == "" {
+			sum := sha256.Sum256(key)
+			id = hex.EncodeToString(sum[:4])
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("encryption key %q is given twice", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		if k.current == "" {
+			k.current = id
+		}
+	}
+	return k, nil
+}
+
+// KeyID names the key new values are encrypted with
+func (k *Keyring) KeyID() string {
+	return k.current
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts value under a fresh data key, which is itself encrypted
+// with the current key. Empty values stay empty.
+func (k *Keyring) seal(value string) (string, error) {
+	if k == nil || value == "" {
+		return value, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	kek := k.keys[k.current]
+	// The key ID is authenticated with the data key, so it can't be swapped
+	ad := []byte(k.current)
+
+	wrapped := sealWith(kek, dataKey, ad)
+	body := sealWith(data, []byte(value), ad)
+	envelope := append([]byte{byte(len(wrapped))}, wrapped...)
+	envelope = append(envelope, body...)
+	return sealedPrefix + k.current + ":" + base64.RawStdEncoding.EncodeToString(envelope), nil
+}
+
+func sealWith(aead cipher.AEAD, plaintext, ad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, ad)
+}
+
+// open decrypts a sealed value. Anything else is returned as it is, values
+// written before encryption was switched on are plain.
+func (k *Keyring) open(value string) (string, error) {
+	id, encoded, ok := sealedKeyID(value)
+	if !ok {
+		return value, nil
+	}
+	if k == nil {
+		return "", errNoKey
+	}
+	kek, found := k.keys[id]
+	if !found {
+		return "", fmt.Errorf("value is encrypted with key %q, which is not configured", id)
+	}
+	envelope, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(envelope) < 1 || len(envelope) < 1+int(envelope[0]) {
+		return "", errors.New("encrypted value is corrupt")
+	}
+	ad := []byte(id)
+	dataKey, err := openWith(kek, envelope[1:1+envelope[0]], ad)
+	if err != nil {
+		return "", fmt.Errorf("decrypting data key with key %q: %w", id, err)
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := openWith(data, envelope[1+envelope[0]:], ad)
+	if err != nil {
+		return "", fmt.Errorf("decrypting value: %w", err)
+	}
+	return string(plain), nil
+}
+
+func openWith(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+}
+
+// sealedKeyID returns the key ID and envelope of a sealed value
+func sealedKeyID(value string) (id, envelope string, ok bool) {
+	rest, found := strings.CutPrefix(value, sealedPrefix)
+	if !found {
+		return "", "", false
+	}
+	return strings.Cut(rest, ":")
+}
+
+// sensitiveKeys are the settings that are encrypted when a key is set
+var sensitiveKeys = map[string]bool{
+	"basiq_user_id": true,
+	legacyImportKey: true,
+	// Entered on the settings page, the Firefly token is covered by its name
+	"setting_basiq_api_key": true,
+}
+
+// sensitiveKey tells whether a setting is encrypted. Tokens and secrets are
+// by their name.
+func sensitiveKey(key string) bool {
+	return sensitiveKeys[key] || strings.HasSuffix(key, "_token") || strings.HasSuffix(key, "_secret")
+}
+
+// sensitiveColumns hold raw Basiq data, which carries account and
+// connection identifiers, and the Firefly payloads built from it, which
+// carry descriptions, amounts and counterparties
+var sensitiveColumns = []struct{ table, id, column string }{
+	{"failed_transactions", "id", "source_payload"},
+	{"failed_transactions", "id", "firefly_payload"},
+	{"match_reviews", "basiq_transaction_id", "source_payload"},
+	{"match_reviews", "basiq_transaction_id", "firefly_payload"},
+	{"imported_transactions", "basiq_transaction_id", "firefly_payload"},
+	{"imported_transactions", "basiq_transaction_id", "pending_payload"},
+}
+
+// reseal encrypts sensitive values that are plain, and with rotate also
+// those encrypted with a key other than the current one. It returns how
+// many values were written.
+func (d *DB) reseal(rotate bool) (int, error) {
+	if d.keys == nil {
+		return 0, nil
+	}
+	stale := func(value string) bool {
+		id, _, sealed := sealedKeyID(value)
+		return value != "" && (!sealed || (rotate && id != d.keys.current))
+	}
+
+	type update struct{ query, id, value string }
+	var updates []update
+
+	rows, err := d.query("SELECT key, COALESCE(value, '') FROM kv_store")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if sensitiveKey(key) && stale(value) {
+			updates = append(updates, update{"UPDATE kv_store SET value = ? WHERE key = ?", key, value})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, c := range sensitiveColumns {
+		rows, err := d.query(fmt.Sprintf("SELECT CAST(%s AS TEXT), %s FROM %s", c.id, c.column, c.table))
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var id, value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if stale(value) {
+				updates = append(updates, update{fmt.Sprintf("UPDATE %s SET %s = ? WHERE CAST(%s AS TEXT) = ?", c.table, c.column, c.id), id, value})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	err = d.InTx(func(s Store) error {
+		tx := s.(*DB)
+		for _, u := range updates {
+			plain, err := d.keys.open(u.value)
+			if err != nil {
+				return err
+			}
+			sealed, err := d.keys.seal(plain)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.exec(u.query, sealed, u.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(updates), nil
+}
+
+// encryptPlain encrypts sensitive values left plain, from before a key was
+// set or by the old importer. On SQLite the plain copies left in free
+// pages, the WAL and the backups taken before migrating go as well.
+func (d *DB) encryptPlain(path string) error {
+	n, err := d.reseal(false)
+	if err != nil {
+		return fmt.Errorf("encrypting sensitive values: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	log.Printf("Encrypted %d sensitive value(s) with key %q", n, d.keys.current)
+	if err := d.compact(); err != nil {
+		return err
+	}
+	return d.encryptBackups(path)
+}
+
+// compact rewrites the SQLite file and empties the WAL, so nothing
+// overwritten is left behind in either
+func (d *DB) compact() error {
+	if d.dialect.name != DriverSQLite {
+		return nil
+	}
+	if _, err := d.Conn.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("compacting the database: %w", err)
+	}
+	var busy, frames, done int
+	if err := d.Conn.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &frames, &done); err != nil {
+		return fmt.Errorf("checkpointing the WAL: %w", err)
+	}
+	if busy != 0 {
+		return errors.New("checkpointing the WAL: the database is busy, try again")
+	}
+	return nil
+}
+
+// encryptBackups encrypts the sensitive values in the backups taken next
+// to the database before migrating. A backup that can't be encrypted is
+// removed rather than left in plain text.
+func (d *DB) encryptBackups(path string) error {
+	path, _, _ = strings.Cut(path, "?")
+	if path == "" || path == ":memory:" {
+		return nil
+	}
+	files, err := filepath.Glob(path + ".v*-*.bak")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		n, err := d.encryptBackup(file)
+		if err == nil {
+			if n > 0 {
+				log.Printf("Encrypted %d sensitive value(s) in the backup %s", n, file)
+			}
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("removing the backup %s, which holds values in plain text: %w", file, err)
+		}
+		log.Printf("Removed the backup %s, it held values in plain text that couldn't be encrypted: %v", file, err)
+	}
+	return nil
+}
+
+func (d *DB) encryptBackup(file string) (int, error) {
+	conn, err := sql.Open("sqlite", file+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetMaxOpenConns(1)
+	backup := &DB{Conn: conn, dialect: sqliteDialect, keys: d.keys}
+	n, err := backup.reseal(false)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	return n, backup.compact()
+}
+
+// RotateKey encrypts every sensitive value with the first configured key.
+// Afterwards the other keys are no longer needed. On SQLite the file is
+// compacted and the WAL emptied, so no copies under the old key are left in
+// free pages.
+func (d *DB) RotateKey() (int, error) {
+	if d.keys == nil {
+		return 0, errors.New("DB_ENCRYPTION_KEY is not set")
+	}
+	n, err := d.reseal(true)
+	if err != nil {
+		return n, err
+	}
+	if n > 0 {
+		if err := d.compact(); err != nil {
+			return n, err
+		}
+	}
+	log.Printf("Re-encrypted %d value(s) with key %q", n, d.keys.current)
+	return n, nil
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Failed transaction states
+const (
+	FailedPending   = "pending"
+	FailedResolved  = "resolved"
+	FailedDismissed = "dismissed"
+)
+
+// FailedTransaction is a Basiq transaction that could not be imported.
+// SourcePayload is the Basiq transaction as JSON, FireflyPayload the
+// transaction we tried to create, which the user may edit before retrying.
+type FailedTransaction struct {
+	ID                 int64
+	BasiqTransactionID string
+	BasiqAccountID     string
+	PostDate           string
+	Description        string
+	Amount             string
+	SourcePayload      string
+	FireflyPayload     string
+	Error              string
+	Attempts           int
+	Status             string
+	Edited             bool
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+const failedColumns = `id, basiq_transaction_id, basiq_account_id, post_date, description, amount,
+	source_payload, firefly_payload, error, attempts, status, edited, created_at, updated_at`
+
+func (d *DB) scanFailed(row interface{ Scan(...interface{}) error }) (*FailedTransaction, error) {
+	var f FailedTransaction
+	var createdAt, updatedAt int64
+	err := row.Scan(&f.ID, &f.BasiqTransactionID, &f.BasiqAccountID, &f.PostDate, &f.Description, &f.Amount,
+		&f.SourcePayload, &f.FireflyPayload, &f.Error, &f.Attempts, &f.Status, &f.Edited, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	f.CreatedAt = time.Unix(createdAt, 0)
+	f.UpdatedAt = time.Unix(updatedAt, 0)
+	if f.SourcePayload, err = d.keys.open(f.SourcePayload); err != nil {
+		return nil, err
+	}
+	f.FireflyPayload, err = d.keys.open(f.FireflyPayload)
+	return &f, err
+}
+
+// SaveFailedTransaction records a failed import attempt. If the transaction
+// failed before, the attempt counter and error are updated; a payload the
+// user edited is kept, and a dismissed transaction stays dismissed.
+func (d *DB) SaveFailedTransaction(f FailedTransaction) error {
+	source, err := d.keys.seal(f.SourcePayload)
+	if err != nil {
+		return err
+	}
+	payload, err := d.keys.seal(f.FireflyPayload)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = d.exec(`INSERT INTO failed_transactions (basiq_transaction_id, basiq_account_id, post_date,
+	          description, amount, source_payload, firefly_payload, error, attempts, status, edited, created_at, updated_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, ?, 0, ?, ?)
+	          ON CONFLICT(basiq_transaction_id) DO UPDATE SET
+	          source_payload = excluded.source_payload,
+	          firefly_payload = CASE WHEN failed_transactions.edited = 1 THEN failed_transactions.firefly_payload ELSE excluded.firefly_payload END,
+	          error = excluded.error,
+	          attempts = failed_transactions.attempts + 1,
+	          status = CASE WHEN failed_transactions.status = 'dismissed' THEN 'dismissed' ELSE 'pending' END,
+	          updated_at = excluded.updated_at`,
+		f.BasiqTransactionID, f.BasiqAccountID, f.PostDate, f.Description, f.Amount,
+		source, payload, f.Error, FailedPending, now, now)
+	return err
+}
+
+// GetFailedTransactions returns failed transactions in the given state,
+// oldest first
+func (d *DB) GetFailedTransactions(status string) ([]FailedTransaction, error) {
+	return d.queryFailed("SELECT "+failedColumns+" FROM failed_transactions WHERE status = ? ORDER BY post_date, id", status)
+}
+
+// GetRetryableTransactions returns the pending failed transactions of an
+// account that have been attempted fewer than maxAttempts times
+func (d *DB) GetRetryableTransactions(basiqAccountID string, maxAttempts int) ([]FailedTransaction, error) {
+	return d.queryFailed("SELECT "+failedColumns+` FROM failed_transactions
+	          WHERE basiq_account_id = ? AND status = ? AND attempts < ? ORDER BY post_date, id`,
+		basiqAccountID, FailedPending, maxAttempts)
+}
+
+// CountFailedTransactions returns the number of failed transactions in the given state
+func (d *DB) CountFailedTransactions(status string) (int, error) {
+	var n int
+	err := d.queryRow("SELECT count(*) FROM failed_transactions WHERE status = ?", status).Scan(&n)
+	return n, err
+}
+
+func (d *DB) queryFailed(query string, args ...interface{}) ([]FailedTransaction, error) {
+	rows, err := d.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failed []FailedTransaction
+	for rows.Next() {
+		f, err := d.scanFailed(rows)
+		if err != nil {
+			return nil, err
+		}
+		failed = append(failed, *f)
+	}
+	return failed, rows.Err()
+}
+
+// GetFailedTransaction returns a single failed transaction, or nil
+func (d *DB) GetFailedTransaction(id int64) (*FailedTransaction, error) {
+	f, err := d.scanFailed(d.queryRow("SELECT "+failedColumns+" FROM failed_transactions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return f, err
+}
+
+// GetFailedTransactionByBasiqID returns the failed transaction for a Basiq
+// transaction ID, or nil
+func (d *DB) GetFailedTransactionByBasiqID(basiqID string) (*FailedTransaction, error) {
+	f, err := d.scanFailed(d.queryRow("SELECT "+failedColumns+" FROM failed_transactions WHERE basiq_transaction_id = ?", basiqID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return f, err
+}
+
+// UpdateFailedPayload replaces the Firefly payload with a user edited one.
+// Edited payloads are not overwritten by later sync attempts.
+func (d *DB) UpdateFailedPayload(id int64, payload string) error {
+	payload, err := d.keys.seal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = d.exec("UPDATE failed_transactions SET firefly_payload = ?, edited = 1, updated_at = ? WHERE id = ?",
+		payload, time.Now().Unix(), id)
+	return err
+}
+
+// RecordFailedAttempt stores the error of another unsuccessful retry
+func (d *DB) RecordFailedAttempt(id int64, errMsg string) error {
+	_, err := d.exec("UPDATE failed_transactions SET error = ?, attempts = attempts + 1, updated_at = ? WHERE id = ?",
+		errMsg, time.Now().Unix(), id)
+	return err
+}
+
+// SetFailedStatus marks a failed transaction resolved, dismissed or pending again
+func (d *DB) SetFailedStatus(id int64, status string) error {
+	_, err := d.exec("UPDATE failed_transactions SET status = ?, updated_at = ? WHERE id = ?",
+		status, time.Now().Unix(), id)
+	return err
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Job types
+const (
+	JobSyncAccount       = "sync_account"
+	JobBackfillRange     = "backfill_range"
+	JobRefreshConnection = "refresh_connection"
+	JobRetryFailedTx     = "retry_failed_tx"
+	JobRollbackRun       = "rollback_run"
+	JobBackup            = "backup"
+)
+
+// Job states
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a unit of background work. Payload is JSON, its shape depends on Type.
+type Job struct {
+	ID          int64
+	Type        string
+	Payload     string
+	State       string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	ScheduledAt time.Time
+	LeaseOwner  string
+	LeasedUntil time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Finished reports whether the job reached a terminal state
+func (j Job) Finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed || j.State == JobCancelled
+}
+
+const jobColumns = `id, type, payload, state, attempts, max_attempts, last_error,
+	scheduled_at, lease_owner, leased_until, created_at, updated_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var j Job
+	var scheduledAt, leasedUntil, createdAt, updatedAt int64
+	err := row.Scan(&j.ID, &j.Type, &j.Payload, &j.State, &j.Attempts, &j.MaxAttempts, &j.LastError,
+		&scheduledAt, &j.LeaseOwner, &leasedUntil, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	j.ScheduledAt = time.Unix(scheduledAt, 0)
+	if leasedUntil > 0 {
+		j.LeasedUntil = time.Unix(leasedUntil, 0)
+	}
+	j.CreatedAt = time.Unix(createdAt, 0)
+	j.UpdatedAt = time.Unix(updatedAt, 0)
+	return &j, nil
+}
+
+// EnqueueJob adds a job to the queue. If an identical job is already
+// pending, its ID is returned instead of queueing a duplicate, and it runs
+// at the earlier of the two times, so a retry waiting out its backoff
+// doesn't hold back a sync asked for now. The unique index on pending jobs
+// makes this hold for concurrent callers too.
+func (d *DB) EnqueueJob(jobType, payload string, scheduledAt time.Time, maxAttempts int) (int64, error) {
+	var id int64
+	now := time.Now().Unix()
+	err := d.queryRow(`INSERT INTO jobs (type, payload, state, attempts, max_attempts, last_error,
+	          scheduled_at, lease_owner, leased_until, created_at, updated_at)
+	          VALUES (?, ?, ?, 0, ?, '', ?, '', 0, ?, ?)
+	          ON CONFLICT (type, payload) WHERE state = 'pending' DO UPDATE SET updated_at = excluded.updated_at,
+	          scheduled_at = `+d.dialect.least+`(jobs.scheduled_at, excluded.scheduled_at)
+	          RETURNING id`,
+		jobType, payload, JobPending, maxAttempts, scheduledAt.Unix(), now, now).Scan(&id)
+	return id, err
+}
+
+// LeaseJob claims the next runnable job for owner until the lease expires.
+// Running jobs whose lease has expired (e.g. the process died) are picked
+// up again while they have attempts left, and failed once they haven't.
+// Returns nil if nothing is runnable.
+func (d *DB) LeaseJob(owner string, lease time.Duration) (*Job, error) {
+	now := time.Now()
+	if _, err := d.exec(`UPDATE jobs SET state = ?, last_error = ?, leased_until = 0, updated_at = ?
+	          WHERE state = ? AND leased_until < ? AND attempts >= max_attempts`,
+		JobFailed, "lease expired, the worker running it stopped", now.Unix(), JobRunning, now.Unix()); err != nil {
+		return nil, err
+	}
+
+	row := d.queryRow(`UPDATE jobs SET state = ?, lease_owner = ?, leased_until = ?,
+	          attempts = attempts + 1, updated_at = ?
+	          WHERE id = (
+	              SELECT id FROM jobs
+	              WHERE (state = ? AND scheduled_at <= ?) OR (state = ? AND leased_until < ? AND attempts < max_attempts)
+	              ORDER BY scheduled_at, id LIMIT 1`+d.dialect.skipLocked+`
+	          )
+	          RETURNING `+jobColumns,
+		JobRunning, owner, now.Add(lease).Unix(), now.Unix(),
+		JobPending, now.Unix(), JobRunning, now.Unix())
+
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// ExtendLease keeps a long running job leased by owner
+func (d *DB) ExtendLease(id int64, owner string, lease time.Duration) error {
+	now := time.Now()
+	_, err := d.exec("UPDATE jobs SET leased_until = ?, updated_at = ? WHERE id = ? AND state = ? AND lease_owner = ?",
+		now.Add(lease).Unix(), now.Unix(), id, JobRunning, owner)
+	return err
+}
+
+// CompleteJob marks a running job as succeeded
+func (d *DB) CompleteJob(id int64) error {
+	_, err := d.exec("UPDATE jobs SET state = ?, last_error = '', leased_until = 0, updated_at = ? WHERE id = ? AND state = ?",
+		JobSucceeded, time.Now().Unix(), id, JobRunning)
+	return err
+}
+
+// FailJob records a failed attempt. The job is rescheduled for retryAt
+// unless it has used up its attempts, or an identical job was queued
+// meanwhile which will do the work instead.
+func (d *DB) FailJob(id int64, errMsg string, retryAt time.Time) error {
+	retry := `attempts < max_attempts AND NOT EXISTS (
+	              SELECT 1 FROM jobs queued WHERE queued.type = jobs.type AND queued.payload = jobs.payload
+	              AND queued.state = 'pending')`
+	_, err := d.exec(`UPDATE jobs SET
+	          state = CASE WHEN `+retry+` THEN ? ELSE ? END,
+	          scheduled_at = CASE WHEN `+retry+` THEN ? ELSE scheduled_at END,
+	          last_error = ?, leased_until = 0, updated_at = ?
+	          WHERE id = ? AND state = ?`,
+		JobPending, JobFailed, retryAt.Unix(), errMsg, time.Now().Unix(), id, JobRunning)
+	return err
+}
+
+// CancelJob cancels a pending or running job. Returns false if the job
+// had already finished.
+func (d *DB) CancelJob(id int64) (bool, error) {
+	res, err := d.exec("UPDATE jobs SET state = ?, leased_until = 0, updated_at = ? WHERE id = ? AND state IN (?, ?)",
+		JobCancelled, time.Now().Unix(), id, JobPending, JobRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetJob returns a single job, or nil if it does not exist
+func (d *DB) GetJob(id int64) (*Job, error) {
+	job, err := scanJob(d.queryRow("SELECT "+jobColumns+" FROM jobs WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// GetJobs returns the most recent jobs, newest first
+func (d *DB) GetJobs(limit int) ([]Job, error) {
+	rows, err := d.query("SELECT "+jobColumns+" FROM jobs ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// PruneJobs deletes finished jobs last updated before the given time
+func (d *DB) PruneJobs(before time.Time) error {
+	_, err := d.exec("DELETE FROM jobs WHERE state IN (?, ?, ?) AND updated_at < ?",
+		JobSucceeded, JobFailed, JobCancelled, before.Unix())
+	return err
+}
@@ -2,48 +2,157 @@ package storage
 
 import (
 	"database/sql"
+	"strings"
 )
 
 // SetKV stores a key-value pair
 func (d *DB) SetKV(key, value string) error {
+	if sensitiveKey(key) {
+		var err error
+		if value, err = d.keys.seal(value); err != nil {
+			return err
+		}
+	}
 	query := `INSERT INTO kv_store (key, value) VALUES (?, ?)
 	          ON CONFLICT(key) DO UPDATE SET value = excluded.value`
-	_, err := d.Conn.Exec(query, key, value)
+	_, err := d.exec(query, key, value)
 	return err
 }
 
 // GetKV retrieves a value by key
 func (d *DB) GetKV(key string) (string, error) {
 	var value string
-	err := d.Conn.QueryRow("SELECT value FROM kv_store WHERE key = ?", key).Scan(&value)
+	err := d.queryRow("SELECT value FROM kv_store WHERE key = ?", key).Scan(&value)
 	if err == sql.ErrNoRows {
 		return "", nil
 	}
-	return value, err
+	if err != nil || !sensitiveKey(key) {
+		return value, err
+	}
+	return d.keys.open(value)
 }
 
+// DeleteKV removes a key
+func (d *DB) DeleteKV(key string) error {
+	_, err := d.exec("DELETE FROM kv_store WHERE key = ?", key)
+	return err
+}
+
+// Pending transaction policies
+const (
+	// PendingImport imports pending transactions like posted ones
+	PendingImport = "import"
+	// PendingSkip leaves pending transactions until they are posted
+	PendingSkip = "skip"
+)
+
 // AccountMapping represents a link between Basiq and Firefly
 type AccountMapping struct {
 	ID               int
 	BasiqAccountID   string
 	FireflyAccountID string
 	AccountName      string
+	// Schedule is a cron expression overriding the global schedule, empty for default
+	Schedule string
+	// FireflyAccountKind is asset, credit_card or liability, empty if not yet known
+	FireflyAccountKind string
+	// PaymentAccountID is the Firefly asset account that pays off a credit
+	// card or liability
+	PaymentAccountID string
+	// Disabled mappings are kept but not synced
+	Disabled bool
+	// StartDate is the YYYY-MM-DD date before which nothing is imported,
+	// empty for no limit
+	StartDate string
+	// InvertSign flips Basiq amounts for banks that report them the wrong way round
+	InvertSign bool
+	// PendingPolicy is PendingImport or PendingSkip, empty means PendingImport
+	PendingPolicy string
+	// Tags are comma separated tags added to every imported transaction
+	Tags string
+	// Category is used for imported transactions that don't get one otherwise
+	Category string
+}
+
+// TagList returns the mapping's default tags
+func (m AccountMapping) TagList() []string {
+	var tags []string
+	for _, t := range strings.Split(m.Tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
 }
 
 // SaveMapping saves or updates an account mapping
 func (d *DB) SaveMapping(mapping AccountMapping) error {
-	query := `INSERT INTO account_mappings (basiq_account_id, firefly_account_id, account_name)
-	          VALUES (?, ?, ?)
+	query := `INSERT INTO account_mappings (basiq_account_id, firefly_account_id, account_name, schedule,
+	          firefly_account_kind, payment_account_id, disabled, start_date, invert_sign, pending_policy, tags, category)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	          ON CONFLICT(basiq_account_id) DO UPDATE SET
 	          firefly_account_id = excluded.firefly_account_id,
-	          account_name = excluded.account_name`
-	_, err := d.Conn.Exec(query, mapping.BasiqAccountID, mapping.FireflyAccountID, mapping.AccountName)
+	          account_name = excluded.account_name,
+	          schedule = excluded.schedule,
+	          firefly_account_kind = excluded.firefly_account_kind,
+	          payment_account_id = excluded.payment_account_id,
+	          disabled = excluded.disabled,
+	          start_date = excluded.start_date,
+	          invert_sign = excluded.invert_sign,
+	          pending_policy = excluded.pending_policy,
+	          tags = excluded.tags,
+	          category = excluded.category`
+	_, err := d.exec(query, mapping.BasiqAccountID, mapping.FireflyAccountID, mapping.AccountName, mapping.Schedule,
+		mapping.FireflyAccountKind, mapping.PaymentAccountID, boolInt(mapping.Disabled), mapping.StartDate, boolInt(mapping.InvertSign),
+		mapping.PendingPolicy, mapping.Tags, mapping.Category)
+	return err
+}
+
+// DeleteMapping removes an account mapping
+func (d *DB) DeleteMapping(basiqID string) error {
+	_, err := d.exec("DELETE FROM account_mappings WHERE basiq_account_id = ?", basiqID)
+	return err
+}
+
+// SetMappingDisabled pauses or resumes syncing of a mapping
+func (d *DB) SetMappingDisabled(basiqID string, disabled bool) error {
+	_, err := d.exec("UPDATE account_mappings SET disabled = ? WHERE basiq_account_id = ?", boolInt(disabled), basiqID)
 	return err
 }
 
-// GetMappings returns all account mappings
+// SetMappingKind stores the kind of the Firefly account a mapping points to
+func (d *DB) SetMappingKind(basiqID, kind string) error {
+	_, err := d.exec("UPDATE account_mappings SET firefly_account_kind = ? WHERE basiq_account_id = ?", kind, basiqID)
+	return err
+}
+
+// IsPaymentAccount reports whether a Firefly account pays off any mapped
+// credit card or liability
+func (d *DB) IsPaymentAccount(fireflyID string) (bool, error) {
+	var n int
+	err := d.queryRow("SELECT count(*) FROM account_mappings WHERE payment_account_id = ?", fireflyID).Scan(&n)
+	return n > 0, err
+}
+
+const mappingColumns = `id, basiq_account_id, firefly_account_id, account_name, COALESCE(schedule, ''),
+	COALESCE(firefly_account_kind, ''), COALESCE(payment_account_id, ''), COALESCE(disabled, 0),
+	COALESCE(start_date, ''), COALESCE(invert_sign, 0), COALESCE(pending_policy, ''), COALESCE(tags, ''),
+	COALESCE(category, '')`
+
+func scanMapping(row interface{ Scan(...interface{}) error }) (*AccountMapping, error) {
+	var m AccountMapping
+	err := row.Scan(&m.ID, &m.BasiqAccountID, &m.FireflyAccountID, &m.AccountName, &m.Schedule,
+		&m.FireflyAccountKind, &m.PaymentAccountID, &m.Disabled, &m.StartDate, &m.InvertSign,
+		&m.PendingPolicy, &m.Tags, &m.Category)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetMappings returns all account mappings, including disabled ones
 func (d *DB) GetMappings() ([]AccountMapping, error) {
-	rows, err := d.Conn.Query("SELECT id, basiq_account_id, firefly_account_id, account_name FROM account_mappings")
+	rows, err := d.query("SELECT " + mappingColumns + " FROM account_mappings")
 	if err != nil {
 		return nil, err
 	}
@@ -51,24 +160,20 @@ func (d *DB) GetMappings() ([]AccountMapping, error) {
 
 	var mappings []AccountMapping
 	for rows.Next() {
-		var m AccountMapping
-		if err := rows.Scan(&m.ID, &m.BasiqAccountID, &m.FireflyAccountID, &m.AccountName); err != nil {
+		m, err := scanMapping(rows)
+		if err != nil {
 			return nil, err
 		}
-		mappings = append(mappings, m)
+		mappings = append(mappings, *m)
 	}
-	return mappings, nil
+	return mappings, rows.Err()
 }
 
 // GetMappingByBasiqID returns a single mapping
 func (d *DB) GetMappingByBasiqID(basiqID string) (*AccountMapping, error) {
-	var m AccountMapping
-	err := d.Conn.QueryRow("SELECT id, basiq_account_id, firefly_account_id, account_name FROM account_mappings WHERE basiq_account_id = ?", basiqID).Scan(&m.ID, &m.BasiqAccountID, &m.FireflyAccountID, &m.AccountName)
+	m, err := scanMapping(d.queryRow("SELECT "+mappingColumns+" FROM account_mappings WHERE basiq_account_id = ?", basiqID))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
-	return &m, nil
+	return m, err
 }
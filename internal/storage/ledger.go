@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ImportedTransaction links a Basiq transaction to the Firefly transaction
+// created for it
+type ImportedTransaction struct {
+	BasiqTransactionID string
+	BasiqAccountID     string
+	FireflyGroupID     string
+	FireflyJournalID   string
+	PostDate           string
+	Amount             string
+	Reconciled         bool
+	// RunID is the sync run that created the transaction, 0 for backfills and manual retries
+	RunID int64
+	// PayloadHash fingerprints the Basiq transaction as last imported,
+	// FireflyPayload is what we last sent to Firefly
+	PayloadHash    string
+	FireflyPayload string
+	// PendingHash and PendingPayload hold a change at Basiq that waits for review
+	PendingHash    string
+	PendingPayload string
+	// State is empty while the transaction is at Basiq as imported, see
+	// the Import* constants otherwise
+	State string
+	// Counterpart is the other Basiq transaction of a reversal pair
+	Counterpart string
+	// Linked is set when the Firefly transaction was there before and was
+	// only linked to the Basiq one, the importer didn't create it
+	Linked bool
+	// Missed counts the syncs in a row that Basiq didn't return the transaction
+	Missed    int
+	CreatedAt time.Time
+}
+
+// States of an imported transaction that vanished from Basiq or was reversed
+const (
+	// ImportReview waits for a decision on the review page
+	ImportReview = "review"
+	// ImportReversal is the reversing side of a pair
+	ImportReversal = "reversal"
+	// ImportReversed was tagged as reversed in Firefly
+	ImportReversed = "reversed"
+	ImportDeleted  = "deleted"
+	ImportKept     = "kept"
+)
+
+// SaveImported records a transaction created in Firefly
+func (d *DB) SaveImported(t ImportedTransaction) error {
+	payload, err := d.keys.seal(t.FireflyPayload)
+	if err != nil {
+		return err
+	}
+	_, err = d.exec(`INSERT INTO imported_transactions (basiq_transaction_id, basiq_account_id,
+	          firefly_group_id, firefly_journal_id, post_date, amount, run_id, payload_hash, firefly_payload, linked, created_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	          ON CONFLICT(basiq_transaction_id) DO UPDATE SET
+	          firefly_group_id = excluded.firefly_group_id,
+	          firefly_journal_id = excluded.firefly_journal_id,
+	          post_date = excluded.post_date,
+	          amount = excluded.amount,
+	          run_id = excluded.run_id,
+	          payload_hash = excluded.payload_hash,
+	          firefly_payload = excluded.firefly_payload,
+	          linked = excluded.linked,
+	          missed = 0`,
+		t.BasiqTransactionID, t.BasiqAccountID, t.FireflyGroupID, t.FireflyJournalID, t.PostDate, t.Amount,
+		t.RunID, t.PayloadHash, payload, boolInt(t.Linked), time.Now().Unix())
+	return err
+}
+
+const importedColumns = `basiq_transaction_id, basiq_account_id, firefly_group_id, firefly_journal_id,
+	post_date, amount, reconciled, run_id, payload_hash, firefly_payload, pending_hash, pending_payload, state, counterpart, linked, missed, created_at`
+
+func (d *DB) scanImported(row interface{ Scan(...interface{}) error }) (*ImportedTransaction, error) {
+	var t ImportedTransaction
+	var createdAt int64
+	err := row.Scan(&t.BasiqTransactionID, &t.BasiqAccountID, &t.FireflyGroupID, &t.FireflyJournalID,
+		&t.PostDate, &t.Amount, &t.Reconciled, &t.RunID, &t.PayloadHash, &t.FireflyPayload,
+		&t.PendingHash, &t.PendingPayload, &t.State, &t.Counterpart, &t.Linked, &t.Missed, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	t.CreatedAt = time.Unix(createdAt, 0)
+	if t.FireflyPayload, err = d.keys.open(t.FireflyPayload); err != nil {
+		return nil, err
+	}
+	t.PendingPayload, err = d.keys.open(t.PendingPayload)
+	return &t, err
+}
+
+// GetImported returns the Firefly transaction created for a Basiq
+// transaction, or nil
+func (d *DB) GetImported(basiqTxID string) (*ImportedTransaction, error) {
+	t, err := d.scanImported(d.queryRow("SELECT "+importedColumns+" FROM imported_transactions WHERE basiq_transaction_id = ?", basiqTxID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+// GetUnreconciledImports returns the account's imported transactions that
+// are not marked reconciled in Firefly yet
+func (d *DB) GetUnreconciledImports(basiqAccountID string) ([]ImportedTransaction, error) {
+	return d.queryImported("SELECT "+importedColumns+` FROM imported_transactions
+	          WHERE basiq_account_id = ? AND reconciled = 0 AND state != ? ORDER BY post_date`, basiqAccountID, ImportDeleted)
+}
+
+// GetImportedByRun returns the transactions a sync run created
+func (d *DB) GetImportedByRun(runID int64) ([]ImportedTransaction, error) {
+	return d.queryImported("SELECT "+importedColumns+" FROM imported_transactions WHERE run_id = ? ORDER BY post_date", runID)
+}
+
+func (d *DB) queryImported(query string, args ...interface{}) ([]ImportedTransaction, error) {
+	rows, err := d.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var imported []ImportedTransaction
+	for rows.Next() {
+		t, err := d.scanImported(rows)
+		if err != nil {
+			return nil, err
+		}
+		imported = append(imported, *t)
+	}
+	return imported, rows.Err()
+}
+
+// SetImportedReconciled records that an imported transaction was marked
+// reconciled in Firefly
+func (d *DB) SetImportedReconciled(basiqTxID string) error {
+	_, err := d.exec("UPDATE imported_transactions SET reconciled = 1 WHERE basiq_transaction_id = ?", basiqTxID)
+	return err
+}
+
+// DeleteImported forgets an imported transaction, e.g. after it was
+// deleted from Firefly
+func (d *DB) DeleteImported(basiqTxID string) error {
+	_, err := d.exec("DELETE FROM imported_transactions WHERE basiq_transaction_id = ?", basiqTxID)
+	return err
+}
+
+// UpdateImportedPayload records that an imported transaction now matches
+// the given Basiq fingerprint and Firefly payload. Any pending change is
+// cleared.
+func (d *DB) UpdateImportedPayload(basiqTxID, hash, payload, postDate, amount string) error {
+	payload, err := d.keys.seal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = d.exec(`UPDATE imported_transactions SET payload_hash = ?, firefly_payload = ?, post_date = ?,
+	          amount = ?, pending_hash = '', pending_payload = '' WHERE basiq_transaction_id = ?`,
+		hash, payload, postDate, amount, basiqTxID)
+	return err
+}
+
+// SetPendingChange parks a change at Basiq for review
+func (d *DB) SetPendingChange(basiqTxID, hash, payload string) error {
+	payload, err := d.keys.seal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = d.exec("UPDATE imported_transactions SET pending_hash = ?, pending_payload = ? WHERE basiq_transaction_id = ?",
+		hash, payload, basiqTxID)
+	return err
+}
+
+// IgnorePendingChange accepts a change at Basiq without touching Firefly,
+// so it isn't flagged again
+func (d *DB) IgnorePendingChange(basiqTxID string) error {
+	_, err := d.exec(`UPDATE imported_transactions SET payload_hash = pending_hash, pending_hash = '',
+	          pending_payload = '' WHERE basiq_transaction_id = ? AND pending_hash != ''`, basiqTxID)
+	return err
+}
+
+// GetPendingChanges returns the imported transactions with a change waiting
+// for review
+func (d *DB) GetPendingChanges() ([]ImportedTransaction, error) {
+	return d.queryImported("SELECT " + importedColumns + " FROM imported_transactions WHERE pending_hash != '' ORDER BY post_date")
+}
+
+// GetImportedSince returns the account's imported transactions posted on or
+// after the given date
+func (d *DB) GetImportedSince(basiqAccountID, since string) ([]ImportedTransaction, error) {
+	return d.queryImported("SELECT "+importedColumns+` FROM imported_transactions
+	          WHERE basiq_account_id = ? AND post_date >= ? ORDER BY post_date`, basiqAccountID, since)
+}
+
+// SetImportedState records what happened to a transaction that vanished
+// from Basiq or was reversed
+func (d *DB) SetImportedState(basiqTxID, state, counterpart string) error {
+	_, err := d.exec("UPDATE imported_transactions SET state = ?, counterpart = ? WHERE basiq_transaction_id = ?",
+		state, counterpart, basiqTxID)
+	return err
+}
+
+// SetImportedMissed records how many syncs in a row Basiq didn't return
+// the transaction
+func (d *DB) SetImportedMissed(basiqTxID string, missed int) error {
+	_, err := d.exec("UPDATE imported_transactions SET missed = ? WHERE basiq_transaction_id = ?", missed, basiqTxID)
+	return err
+}
+
+// GetVanishedForReview returns the transactions that vanished or were
+// reversed and wait for a decision
+func (d *DB) GetVanishedForReview() ([]ImportedTransaction, error) {
+	return d.queryImported("SELECT "+importedColumns+" FROM imported_transactions WHERE state = ? ORDER BY post_date", ImportReview)
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// legacyImportKey holds the report of the import from the old PHP importer
+const legacyImportKey = "legacy_import"
+
+// LegacyImport reports what was carried over from the old PHP importer
+type LegacyImport struct {
+	UserID string
+	// Connections are the bank connections of the user at Basiq. They stay
+	// there, keeping the user ID is what keeps them working.
+	Connections int
+	Notes       []string
+	ImportedAt  time.Time
+	Dismissed   bool
+}
+
+// GetLegacyImport returns the report of the import from the old PHP
+// importer, or nil if there was none
+func (d *DB) GetLegacyImport() (*LegacyImport, error) {
+	value, err := d.GetKV(legacyImportKey)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var report LegacyImport
+	if err := json.Unmarshal([]byte(value), &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// DismissLegacyImport hides the import report from the dashboard
+func (d *DB) DismissLegacyImport() error {
+	report, err := d.GetLegacyImport()
+	if err != nil || report == nil {
+		return err
+	}
+	report.Dismissed = true
+	value, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return d.SetKV(legacyImportKey, string(value))
+}
+
+// importLegacy carries the Basiq user over from the old PHP importer's
+// tables, once. Nothing already set up here is overwritten. The old
+// importer only kept basiq_users and basiq_connections, it had no account
+// links or sync dates to carry over.
+func (d *DB) importLegacy(tables []string) error {
+	done, err := d.GetKV(legacyImportKey)
+	if err != nil || done != "" {
+		return err
+	}
+
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	report := LegacyImport{ImportedAt: time.Now()}
+	has := make(map[string]bool)
+	for _, t := range tables {
+		has[t] = true
+	}
+
+	if has["basiq_users"] {
+		if err := d.importLegacyUser(tx, has["basiq_connections"], &report); err != nil {
+			return fmt.Errorf("basiq_users: %w", err)
+		}
+	}
+	report.Notes = append(report.Notes, "The old importer didn't keep which Basiq account goes to which Firefly III account, "+
+		"or when each was last synced. Map the accounts again on the mapping page, the first sync then imports the last 30 days.")
+
+	value, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO kv_store (key, value) VALUES (?, ?)
+	          ON CONFLICT(key) DO UPDATE SET value = excluded.value`, legacyImportKey, string(value)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Imported from the old PHP importer: Basiq user %q with %d connection(s)", report.UserID, report.Connections)
+	for _, note := range report.Notes {
+		log.Printf("Legacy import: %s", note)
+	}
+	return nil
+}
+
+// importLegacyUser keeps the most recently updated Basiq user, unless one
+// is set up here already
+func (d *DB) importLegacyUser(tx *sql.Tx, hasConnections bool, report *LegacyImport) error {
+	var id int64
+	var userID string
+	err := tx.QueryRow("SELECT id, basiq_user_id FROM basiq_users WHERE basiq_user_id != '' ORDER BY updated_at DESC, id DESC LIMIT 1").
+		Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		report.Notes = append(report.Notes, "The old importer had no Basiq user, connect your banks again.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var others int
+	if err := tx.QueryRow("SELECT count(*) FROM basiq_users WHERE basiq_user_id != '' AND id != ?", id).Scan(&others); err != nil {
+		return err
+	}
+	if others > 0 {
+		report.Notes = append(report.Notes, fmt.Sprintf("%d other Basiq user(s) were ignored, only one is supported.", others))
+	}
+
+	var existing string
+	err = tx.QueryRow("SELECT value FROM kv_store WHERE key = 'basiq_user_id'").Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if existing, err = d.keys.open(existing); err != nil {
+		return err
+	}
+	if existing != "" && existing != userID {
+		report.Notes = append(report.Notes, fmt.Sprintf("Kept the Basiq user %s set up here over %s from the old importer.", existing, userID))
+		return nil
+	}
+	if _, err := tx.Exec(`INSERT INTO kv_store (key, value) VALUES ('basiq_user_id', ?)
+	          ON CONFLICT(key) DO UPDATE SET value = excluded.value`, userID); err != nil {
+		return err
+	}
+	report.UserID = userID
+
+	if hasConnections {
+		if err := tx.QueryRow("SELECT count(*) FROM basiq_connections WHERE basiq_user_id = ?", id).Scan(&report.Connections); err != nil {
+			return err
+		}
+	}
+	return nil
+}
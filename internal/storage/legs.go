@@ -0,0 +1,40 @@
+package storage
+
+// SaveRepaymentLeg remembers a repayment transfer created from the credit
+// card or liability side, so the matching debit on the paying account is
+// not imported a second time
+func (d *DB) SaveRepaymentLeg(paymentAccountID, amount, date, basiqTxID string) error {
+	_, err := d.exec(`INSERT INTO repayment_legs (payment_account_id, amount, date, basiq_transaction_id)
+	          VALUES (?, ?, ?, ?) ON CONFLICT(basiq_transaction_id) DO NOTHING`,
+		paymentAccountID, amount, date, basiqTxID)
+	return err
+}
+
+// ClaimRepaymentLeg looks for an unclaimed repayment from the paying account
+// with the same amount within windowDays of date. If one exists it is
+// claimed by basiqTxID and true is returned. Claiming is idempotent: a
+// transaction that already claimed a leg claims it again.
+func (d *DB) ClaimRepaymentLeg(paymentAccountID, amount, date, basiqTxID string, windowDays int) (bool, error) {
+	days := d.dialect.dayDiff("date", "?")
+	res, err := d.exec(`UPDATE repayment_legs SET claimed_by = ?
+	          WHERE id = (
+	              SELECT id FROM repayment_legs
+	              WHERE payment_account_id = ? AND amount = ?
+	                AND (claimed_by = '' OR claimed_by = ?)
+	                AND `+days+` <= ?
+	              ORDER BY claimed_by DESC, `+days+`
+	              LIMIT 1
+	          )`,
+		basiqTxID, paymentAccountID, amount, basiqTxID, date, windowDays, date)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteRepaymentLeg forgets the repayment created for a Basiq transaction
+func (d *DB) DeleteRepaymentLeg(basiqTxID string) error {
+	_, err := d.exec("DELETE FROM repayment_legs WHERE basiq_transaction_id = ?", basiqTxID)
+	return err
+}
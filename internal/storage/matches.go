@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// MatchReview is a new Basiq transaction that could be one of several
+// transactions already in Firefly. Candidates is a JSON list of them.
+type MatchReview struct {
+	BasiqTransactionID string
+	BasiqAccountID     string
+	SourcePayload      string
+	FireflyPayload     string
+	Candidates         string
+	CreatedAt          time.Time
+}
+
+// SaveMatchReview holds a transaction until the user picks its match
+func (d *DB) SaveMatchReview(r MatchReview) error {
+	source, err := d.keys.seal(r.SourcePayload)
+	if err != nil {
+		return err
+	}
+	payload, err := d.keys.seal(r.FireflyPayload)
+	if err != nil {
+		return err
+	}
+	_, err = d.exec(`INSERT INTO match_reviews (basiq_transaction_id, basiq_account_id, source_payload,
+	          firefly_payload, candidates, created_at) VALUES (?, ?, ?, ?, ?, ?)
+	          ON CONFLICT(basiq_transaction_id) DO UPDATE SET
+	          source_payload = excluded.source_payload,
+	          firefly_payload = excluded.firefly_payload,
+	          candidates = excluded.candidates`,
+		r.BasiqTransactionID, r.BasiqAccountID, source, payload, r.Candidates, time.Now().Unix())
+	return err
+}
+
+const matchReviewColumns = "basiq_transaction_id, basiq_account_id, source_payload, firefly_payload, candidates, created_at"
+
+func (d *DB) scanMatchReview(row interface{ Scan(...interface{}) error }) (*MatchReview, error) {
+	var r MatchReview
+	var createdAt int64
+	if err := row.Scan(&r.BasiqTransactionID, &r.BasiqAccountID, &r.SourcePayload, &r.FireflyPayload, &r.Candidates, &createdAt); err != nil {
+		return nil, err
+	}
+	r.CreatedAt = time.Unix(createdAt, 0)
+	var err error
+	if r.SourcePayload, err = d.keys.open(r.SourcePayload); err != nil {
+		return nil, err
+	}
+	r.FireflyPayload, err = d.keys.open(r.FireflyPayload)
+	return &r, err
+}
+
+// GetMatchReview returns the held transaction, or nil
+func (d *DB) GetMatchReview(basiqTxID string) (*MatchReview, error) {
+	r, err := d.scanMatchReview(d.queryRow("SELECT "+matchReviewColumns+" FROM match_reviews WHERE basiq_transaction_id = ?", basiqTxID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// GetMatchReviews returns every transaction waiting for a match decision
+func (d *DB) GetMatchReviews() ([]MatchReview, error) {
+	rows, err := d.query("SELECT " + matchReviewColumns + " FROM match_reviews ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reviews []MatchReview
+	for rows.Next() {
+		r, err := d.scanMatchReview(rows)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, *r)
+	}
+	return reviews, rows.Err()
+}
+
+// DeleteMatchReview forgets a held transaction once it's decided
+func (d *DB) DeleteMatchReview(basiqTxID string) error {
+	_, err := d.exec("DELETE FROM match_reviews WHERE basiq_transaction_id = ?", basiqTxID)
+	return err
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one numbered step of the schema. Each runs in its own
+// transaction together with recording its version.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations are applied to SQLite in order. Never change one that was
+// released, add a new one instead, to postgresMigrations as well.
+var migrations = []migration{
+	{1, "baseline", migrateBaseline},
+	{2, "unique pending jobs", migrateUniquePendingJobs},
+	{3, "linked and missed transactions", migrateImportedLinked},
+}
+
+// migrateUniquePendingJobs lets only one identical job wait in the queue,
+// so EnqueueJob can't queue a job twice when called concurrently.
+// Duplicates already waiting are cancelled.
+func migrateUniquePendingJobs(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	UPDATE jobs SET state = 'cancelled' WHERE state = 'pending' AND id NOT IN (
+		SELECT MIN(id) FROM jobs WHERE state = 'pending' GROUP BY type, payload
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS jobs_pending_unique ON jobs (type, payload) WHERE state = 'pending';
+	`)
+	return err
+}
+
+// migrateImportedLinked tells the transactions the importer only linked
+// from the ones it created, and counts the syncs a transaction was missing
+// from Basiq. Links made so far share run 0 with backfills and retries,
+// all of them count as linked so none is deleted without asking.
+func migrateImportedLinked(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE imported_transactions ADD COLUMN linked INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE imported_transactions ADD COLUMN missed INTEGER NOT NULL DEFAULT 0;
+	UPDATE imported_transactions SET linked = 1 WHERE run_id = 0;
+	`)
+	return err
+}
+
+// ownTables are the tables this importer creates, anything else in the
+// database was left by the old PHP importer
+var ownTables = map[string]bool{
+	"schema_version": true, "sqlite_sequence": true, "kv_store": true, "account_mappings": true, "jobs": true,
+	"sync_runs": true, "sync_run_accounts": true, "failed_transactions": true, "repayment_legs": true,
+	"imported_transactions": true, "match_reviews": true, "balance_checks": true,
+}
+
+// migrate brings the schema up to date. The database file is backed up
+// first whenever something is about to change.
+func (d *DB) migrate(path string, opts Options) error {
+	if _, err := d.Conn.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	// Backups and the old PHP importer only concern SQLite, Postgres is
+	// backed up with its own tools
+	var legacy []string
+	if d.dialect.name == DriverSQLite {
+		if legacy, err = d.legacyTables(); err != nil {
+			return err
+		}
+	}
+	migrations := d.dialect.migrations
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this release supports (%d)", current, latest)
+	}
+
+	wipe := opts.LegacyWipe && len(legacy) > 0
+	if (current < latest || wipe) && d.dialect.name == DriverSQLite {
+		if err := d.backup(path, current); err != nil {
+			return fmt.Errorf("backup before migrating: %w", err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		log.Printf("Applying database migration %d (%s)", m.version, m.name)
+		if err := d.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+
+	if len(legacy) == 0 {
+		return nil
+	}
+	if err := d.importLegacy(legacy); err != nil {
+		return fmt.Errorf("importing from the old PHP importer: %w", err)
+	}
+	if !wipe {
+		log.Printf("Tables of the old PHP importer found (%d), set DB_LEGACY_WIPE=true to remove them", len(legacy))
+		return nil
+	}
+	return d.dropLegacyTables(legacy)
+}
+
+func (d *DB) applyMigration(m migration) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(d.rebind("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)"),
+		m.version, m.name, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion returns the version of the last migration applied, 0 for a
+// new database or one from before migrations were numbered
+func (d *DB) SchemaVersion() (int, error) {
+	var version sql.NullInt64
+	err := d.Conn.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
+
+// backup copies the database next to itself before a migration. Nothing is
+// copied for a new, empty database.
+func (d *DB) backup(path string, version int) error {
+	var tables int
+	if err := d.Conn.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_version'").Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 || path == "" || path == ":memory:" {
+		return nil
+	}
+
+	file := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().Format("20060102-150405"))
+	if _, err := d.Conn.Exec("VACUUM INTO ?", file); err != nil {
+		return err
+	}
+	log.Printf("Backed up the database to %s", file)
+	return nil
+}
+
+// legacyTables lists the tables left by the old PHP importer, which
+// created a Laravel migrations table
+func (d *DB) legacyTables() ([]string, error) {
+	var laravel int
+	if err := d.Conn.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'migrations'").Scan(&laravel); err != nil {
+		return nil, err
+	}
+	if laravel == 0 {
+		return nil, nil
+	}
+
+	rows, err := d.Conn.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if !ownTables[name] {
+			tables = append(tables, name)
+		}
+	}
+	return tables, rows.Err()
+}
+
+// dropLegacyTables removes the old PHP importer's tables in one go
+func (d *DB) dropLegacyTables(tables []string) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		if _, err := tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %q", table)); err != nil {
+			return err
+		}
+	}
+	log.Printf("Removed %d tables of the old PHP importer", len(tables))
+	return tx.Commit()
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Run states
+const (
+	RunRunning = "running"
+	RunSuccess = "success"
+	RunPartial = "partial"
+	RunFailed  = "failed"
+	// RunRolledBack runs had their transactions deleted from Firefly again
+	RunRolledBack = "rolled_back"
+)
+
+// SyncRun is one execution of the sync over one or more accounts
+type SyncRun struct {
+	ID         int64
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Status     string
+	Accounts   int
+	Fetched    int
+	Imported   int
+	Skipped    int
+	Failed     int
+	Duration   time.Duration
+	Error      string
+	// Tag is added to every transaction the run creates
+	Tag string
+}
+
+// SyncRunAccount holds the result and timings of one account within a run
+type SyncRunAccount struct {
+	RunID          int64
+	BasiqAccountID string
+	AccountName    string
+	Fetched        int
+	Imported       int
+	Skipped        int
+	Failed         int
+	FetchDuration  time.Duration
+	PostDuration   time.Duration
+	// Since is the cursor the account was synced from, Cursor where it ended
+	Since  string
+	Cursor string
+	Error  string
+	// Balances after the sync, empty if they couldn't be compared
+	BasiqBalance   string
+	FireflyBalance string
+	Drift          string
+}
+
+// HasDrift reports whether the balances didn't match
+func (ra SyncRunAccount) HasDrift() bool {
+	return hasDrift(ra.Drift)
+}
+
+// StartRun records the start of a sync run and returns its ID
+func (d *DB) StartRun(accounts int, tag string) (int64, error) {
+	var id int64
+	err := d.queryRow("INSERT INTO sync_runs (started_at, status, accounts, tag) VALUES (?, ?, ?, ?) RETURNING id",
+		time.Now().Unix(), RunRunning, accounts, tag).Scan(&id)
+	return id, err
+}
+
+// FinishRun stores the totals of a finished run
+func (d *DB) FinishRun(run SyncRun) error {
+	_, err := d.exec(`UPDATE sync_runs SET finished_at = ?, status = ?, fetched = ?, imported = ?,
+	          skipped = ?, failed = ?, duration_ms = ?, error = ? WHERE id = ?`,
+		time.Now().Unix(), run.Status, run.Fetched, run.Imported, run.Skipped, run.Failed,
+		run.Duration.Milliseconds(), run.Error, run.ID)
+	return err
+}
+
+// SetRunStatus changes the status of a finished run
+func (d *DB) SetRunStatus(id int64, status string) error {
+	_, err := d.exec("UPDATE sync_runs SET status = ? WHERE id = ?", status, id)
+	return err
+}
+
+// SaveRunAccount stores the result of one account within a run
+func (d *DB) SaveRunAccount(ra SyncRunAccount) error {
+	_, err := d.exec(`INSERT INTO sync_run_accounts (run_id, basiq_account_id, account_name, fetched,
+	          imported, skipped, failed, fetch_ms, post_ms, since, cursor, error, basiq_balance, firefly_balance, drift)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ra.RunID, ra.BasiqAccountID, ra.AccountName, ra.Fetched, ra.Imported, ra.Skipped, ra.Failed,
+		ra.FetchDuration.Milliseconds(), ra.PostDuration.Milliseconds(), ra.Since, ra.Cursor, ra.Error,
+		ra.BasiqBalance, ra.FireflyBalance, ra.Drift)
+	return err
+}
+
+const runColumns = `id, started_at, finished_at, status, accounts, fetched, imported, skipped, failed, duration_ms, error, tag`
+
+func scanRun(row interface{ Scan(...interface{}) error }) (*SyncRun, error) {
+	var r SyncRun
+	var startedAt, finishedAt, durationMs int64
+	err := row.Scan(&r.ID, &startedAt, &finishedAt, &r.Status, &r.Accounts, &r.Fetched, &r.Imported,
+		&r.Skipped, &r.Failed, &durationMs, &r.Error, &r.Tag)
+	if err != nil {
+		return nil, err
+	}
+	r.StartedAt = time.Unix(startedAt, 0)
+	if finishedAt > 0 {
+		r.FinishedAt = time.Unix(finishedAt, 0)
+	}
+	r.Duration = time.Duration(durationMs) * time.Millisecond
+	return &r, nil
+}
+
+// GetRuns returns the most recent runs, newest first
+func (d *DB) GetRuns(limit int) ([]SyncRun, error) {
+	rows, err := d.query("SELECT "+runColumns+" FROM sync_runs ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []SyncRun
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, *r)
+	}
+	return runs, rows.Err()
+}
+
+// GetRun returns a single run, or nil if it does not exist
+func (d *DB) GetRun(id int64) (*SyncRun, error) {
+	r, err := scanRun(d.queryRow("SELECT "+runColumns+" FROM sync_runs WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// GetRunAccounts returns the per-account results of a run
+func (d *DB) GetRunAccounts(runID int64) ([]SyncRunAccount, error) {
+	rows, err := d.query(`SELECT run_id, basiq_account_id, account_name, fetched, imported, skipped,
+	          failed, fetch_ms, post_ms, since, cursor, error, basiq_balance, firefly_balance, drift
+	          FROM sync_run_accounts WHERE run_id = ? ORDER BY id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []SyncRunAccount
+	for rows.Next() {
+		var ra SyncRunAccount
+		var fetchMs, postMs int64
+		if err := rows.Scan(&ra.RunID, &ra.BasiqAccountID, &ra.AccountName, &ra.Fetched, &ra.Imported,
+			&ra.Skipped, &ra.Failed, &fetchMs, &postMs, &ra.Since, &ra.Cursor, &ra.Error,
+			&ra.BasiqBalance, &ra.FireflyBalance, &ra.Drift); err != nil {
+			return nil, err
+		}
+		ra.FetchDuration = time.Duration(fetchMs) * time.Millisecond
+		ra.PostDuration = time.Duration(postMs) * time.Millisecond
+		accounts = append(accounts, ra)
+	}
+	return accounts, rows.Err()
+}
@@ -3,29 +3,120 @@ package storage
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 
 	_ "modernc.org/sqlite"
 )
 
 type DB struct {
-	Conn *sql.DB
+	Conn    *sql.DB
+	dialect dialect
+	// keys encrypt sensitive values, nil leaves them plain
+	keys *Keyring
+	// tx is set on the store handed to InTx
+	tx *sql.Tx
 }
 
-func New(path string) (*DB, error) {
-	conn, err := sql.Open("sqlite", path)
+// querier is what runs statements, the pool or a transaction
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// SQLite connection settings. WAL lets the UI read while a sync writes,
+// the busy timeout makes writers queue instead of failing with "database
+// is locked", and immediate transactions take the write lock up front so
+// two of them can't deadlock upgrading a read lock. See
+// BenchmarkSaveImportedWhileLeasing.
+const (
+	sqliteParams = "_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)&_pragma=foreign_keys(1)" +
+		"&_pragma=synchronous(NORMAL)&_txlock=immediate"
+	sqliteConns = 4
+)
+
+// Options control how the database is opened
+type Options struct {
+	// LegacyWipe drops the tables of the old PHP importer after the Basiq
+	// user ID has been recovered from them
+	LegacyWipe bool
+	// Keys encrypt sensitive settings and payloads, nil stores them plain
+	Keys *Keyring
+}
+
+// Supported database drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// dialect holds what differs between the supported databases
+type dialect struct {
+	name string
+	// numbered drivers take $1, $2, ... instead of ? placeholders
+	numbered   bool
+	migrations []migration
+	// dayDiff is SQL for the number of days between two dates given as
+	// text starting with YYYY-MM-DD
+	dayDiff func(a, b string) string
+	// skipLocked keeps concurrent workers from leasing the same job
+	skipLocked string
+	// least is the function for the smaller of two values
+	least string
+}
+
+var sqliteDialect = dialect{
+	name:       DriverSQLite,
+	migrations: migrations,
+	least:      "MIN",
+	dayDiff: func(a, b string) string {
+		return fmt.Sprintf("abs(julianday(substr(%s, 1, 10)) - julianday(substr(%s, 1, 10)))", a, b)
+	},
+}
+
+// Open connects to the database of the given driver and brings its schema
+// up to date. For SQLite dsn is the path of the database file.
+func Open(driver, dsn string, opts Options) (Store, error) {
+	switch driver {
+	case DriverSQLite, "":
+		return New(dsn, opts)
+	case DriverPostgres:
+		return NewPostgres(dsn, opts)
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
+}
+
+// New opens the SQLite database at path
+func New(path string, opts Options) (*DB, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	conn, err := sql.Open("sqlite", path+sep+sqliteParams)
 	if err != nil {
 		return nil, err
 	}
+	// Every connection to :memory: is a database of its own
+	if path == ":memory:" {
+		conn.SetMaxOpenConns(1)
+	} else {
+		conn.SetMaxOpenConns(sqliteConns)
+		conn.SetMaxIdleConns(sqliteConns)
+	}
 
 	if err := conn.Ping(); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	db := &DB{Conn: conn}
-	if err := db.cleanupAndMigrate(); err != nil {
+	db := &DB{Conn: conn, dialect: sqliteDialect, keys: opts.Keys}
+	if err := db.migrate(path, opts); err != nil {
 		return nil, fmt.Errorf("migration failed: %w", err)
 	}
+	if err := db.encryptPlain(path); err != nil {
+		return nil, err
+	}
 
 	return db, nil
 }
@@ -34,22 +125,83 @@ func (d *DB) Close() error {
 	return d.Conn.Close()
 }
 
-func (d *DB) cleanupAndMigrate() error {
-	// Check if legacy tables exist
-	var legacyExists int
-	// 'migrations' table often exists in Laravel
-	err := d.Conn.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='migrations'").Scan(&legacyExists)
+// Driver names the database in use
+func (d *DB) Driver() string {
+	return d.dialect.name
+}
+
+// rebind rewrites ? placeholders for drivers that number them
+func (d *DB) rebind(query string) string {
+	if !d.dialect.numbered {
+		return query
+	}
+	var b strings.Builder
+	n, quoted := 0, false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (d *DB) querier() querier {
+	if d.tx != nil {
+		return d.tx
+	}
+	return d.Conn
+}
+
+func (d *DB) exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.querier().Exec(d.rebind(query), args...)
+}
+
+func (d *DB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.querier().Query(d.rebind(query), args...)
+}
+
+func (d *DB) queryRow(query string, args ...interface{}) *sql.Row {
+	return d.querier().QueryRow(d.rebind(query), args...)
+}
+
+// InTx runs fn with a store whose writes are committed together, or not at
+// all if fn fails. fn must only use the store it is given, the database
+// is locked for anything else until it returns. Nested calls join the
+// outer transaction.
+func (d *DB) InTx(fn func(Store) error) error {
+	if d.tx != nil {
+		return fn(d)
+	}
+	tx, err := d.Conn.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	if legacyExists > 0 {
-		log.Println("Legacy database detected. Cleaning up...")
-		if err := d.wipe(); err != nil {
-			return err
-		}
+	if err := fn(&DB{Conn: d.Conn, dialect: d.dialect, keys: d.keys, tx: tx}); err != nil {
+		return err
 	}
+	return tx.Commit()
+}
 
+// boolInt stores flags as 0 or 1, which every database takes for an integer
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// migrateBaseline creates the schema as it was before migrations were
+// numbered. Databases from that time are brought up to it, so it only adds
+// what is missing.
+func migrateBaseline(tx *sql.Tx) error {
 	// Create new schema
 	schema := `
 	CREATE TABLE IF NOT EXISTS kv_store (
@@ -60,36 +212,183 @@ func (d *DB) cleanupAndMigrate() error {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		basiq_account_id TEXT UNIQUE,
 		firefly_account_id TEXT,
-		account_name TEXT
+		account_name TEXT,
+		schedule TEXT DEFAULT '',
+		firefly_account_kind TEXT DEFAULT '',
+		payment_account_id TEXT DEFAULT '',
+		disabled INTEGER DEFAULT 0,
+		start_date TEXT DEFAULT '',
+		invert_sign INTEGER DEFAULT 0,
+		pending_policy TEXT DEFAULT '',
+		tags TEXT DEFAULT '',
+		category TEXT DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		payload TEXT NOT NULL DEFAULT '',
+		state TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 1,
+		last_error TEXT NOT NULL DEFAULT '',
+		scheduled_at INTEGER NOT NULL,
+		lease_owner TEXT NOT NULL DEFAULT '',
+		leased_until INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS jobs_runnable ON jobs (state, scheduled_at);
+	CREATE TABLE IF NOT EXISTS sync_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at INTEGER NOT NULL,
+		finished_at INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		accounts INTEGER NOT NULL DEFAULT 0,
+		fetched INTEGER NOT NULL DEFAULT 0,
+		imported INTEGER NOT NULL DEFAULT 0,
+		skipped INTEGER NOT NULL DEFAULT 0,
+		failed INTEGER NOT NULL DEFAULT 0,
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		tag TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS sync_run_accounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER NOT NULL,
+		basiq_account_id TEXT NOT NULL,
+		account_name TEXT NOT NULL DEFAULT '',
+		fetched INTEGER NOT NULL DEFAULT 0,
+		imported INTEGER NOT NULL DEFAULT 0,
+		skipped INTEGER NOT NULL DEFAULT 0,
+		failed INTEGER NOT NULL DEFAULT 0,
+		fetch_ms INTEGER NOT NULL DEFAULT 0,
+		post_ms INTEGER NOT NULL DEFAULT 0,
+		cursor TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		basiq_balance TEXT NOT NULL DEFAULT '',
+		firefly_balance TEXT NOT NULL DEFAULT '',
+		drift TEXT NOT NULL DEFAULT '',
+		since TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS sync_run_accounts_run ON sync_run_accounts (run_id);
+	CREATE TABLE IF NOT EXISTS failed_transactions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		basiq_transaction_id TEXT NOT NULL UNIQUE,
+		basiq_account_id TEXT NOT NULL,
+		post_date TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		amount TEXT NOT NULL DEFAULT '',
+		source_payload TEXT NOT NULL DEFAULT '',
+		firefly_payload TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		edited INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS failed_transactions_account ON failed_transactions (basiq_account_id, status);
+	CREATE TABLE IF NOT EXISTS repayment_legs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		payment_account_id TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		date TEXT NOT NULL,
+		basiq_transaction_id TEXT NOT NULL UNIQUE,
+		claimed_by TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS imported_transactions (
+		basiq_transaction_id TEXT PRIMARY KEY,
+		basiq_account_id TEXT NOT NULL,
+		firefly_group_id TEXT NOT NULL,
+		firefly_journal_id TEXT NOT NULL DEFAULT '',
+		post_date TEXT NOT NULL DEFAULT '',
+		amount TEXT NOT NULL DEFAULT '',
+		reconciled INTEGER NOT NULL DEFAULT 0,
+		run_id INTEGER NOT NULL DEFAULT 0,
+		payload_hash TEXT NOT NULL DEFAULT '',
+		firefly_payload TEXT NOT NULL DEFAULT '',
+		pending_hash TEXT NOT NULL DEFAULT '',
+		pending_payload TEXT NOT NULL DEFAULT '',
+		state TEXT NOT NULL DEFAULT '',
+		counterpart TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS imported_transactions_account ON imported_transactions (basiq_account_id, post_date);
+	CREATE TABLE IF NOT EXISTS match_reviews (
+		basiq_transaction_id TEXT PRIMARY KEY,
+		basiq_account_id TEXT NOT NULL,
+		source_payload TEXT NOT NULL DEFAULT '',
+		firefly_payload TEXT NOT NULL DEFAULT '',
+		candidates TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS balance_checks (
+		basiq_account_id TEXT PRIMARY KEY,
+		basiq_balance TEXT NOT NULL,
+		firefly_balance TEXT NOT NULL,
+		drift TEXT NOT NULL,
+		checked_at INTEGER NOT NULL
 	);
 	`
-	_, err = d.Conn.Exec(schema)
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema
+	columns := [][3]string{
+		{"account_mappings", "schedule", "TEXT DEFAULT ''"},
+		{"account_mappings", "firefly_account_kind", "TEXT DEFAULT ''"},
+		{"account_mappings", "payment_account_id", "TEXT DEFAULT ''"},
+		{"account_mappings", "disabled", "INTEGER DEFAULT 0"},
+		{"account_mappings", "start_date", "TEXT DEFAULT ''"},
+		{"account_mappings", "invert_sign", "INTEGER DEFAULT 0"},
+		{"account_mappings", "pending_policy", "TEXT DEFAULT ''"},
+		{"account_mappings", "tags", "TEXT DEFAULT ''"},
+		{"account_mappings", "category", "TEXT DEFAULT ''"},
+		{"sync_run_accounts", "basiq_balance", "TEXT NOT NULL DEFAULT ''"},
+		{"sync_run_accounts", "firefly_balance", "TEXT NOT NULL DEFAULT ''"},
+		{"sync_run_accounts", "drift", "TEXT NOT NULL DEFAULT ''"},
+		{"sync_run_accounts", "since", "TEXT NOT NULL DEFAULT ''"},
+		{"sync_runs", "tag", "TEXT NOT NULL DEFAULT ''"},
+		{"imported_transactions", "run_id", "INTEGER NOT NULL DEFAULT 0"},
+		{"imported_transactions", "payload_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"imported_transactions", "firefly_payload", "TEXT NOT NULL DEFAULT ''"},
+		{"imported_transactions", "pending_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"imported_transactions", "pending_payload", "TEXT NOT NULL DEFAULT ''"},
+		{"imported_transactions", "state", "TEXT NOT NULL DEFAULT ''"},
+		{"imported_transactions", "counterpart", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		if err := ensureColumn(tx, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec("CREATE INDEX IF NOT EXISTS imported_transactions_run ON imported_transactions (run_id)")
 	return err
 }
 
-func (d *DB) wipe() error {
-	rows, err := d.Conn.Query("SELECT name FROM sqlite_master WHERE type='table'")
+// ensureColumn adds a column to an existing table if it is missing
+func ensureColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
-	var tables []string
 	for rows.Next() {
 		var name string
 		if err := rows.Scan(&name); err != nil {
 			return err
 		}
-		if name != "sqlite_sequence" {
-			tables = append(tables, name)
+		if name == column {
+			return nil
 		}
 	}
-
-	for _, table := range tables {
-		_, err := d.Conn.Exec("DROP TABLE IF EXISTS " + table)
-		if err != nil {
-			return err
-		}
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	return nil
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
@@ -0,0 +1,102 @@
+package storage
+
+import "time"
+
+// Store is everything the server keeps. DB implements it on SQLite and
+// PostgreSQL.
+type Store interface {
+	// Key/value settings
+	GetKV(key string) (string, error)
+	SetKV(key, value string) error
+	DeleteKV(key string) error
+
+	// Account mappings
+	GetMappings() ([]AccountMapping, error)
+	GetMappingByBasiqID(basiqID string) (*AccountMapping, error)
+	SaveMapping(mapping AccountMapping) error
+	DeleteMapping(basiqID string) error
+	SetMappingDisabled(basiqID string, disabled bool) error
+	SetMappingKind(basiqID, kind string) error
+	IsPaymentAccount(fireflyID string) (bool, error)
+
+	// Imported transactions
+	SaveImported(t ImportedTransaction) error
+	GetImported(basiqTxID string) (*ImportedTransaction, error)
+	GetImportedByRun(runID int64) ([]ImportedTransaction, error)
+	GetImportedSince(basiqAccountID, since string) ([]ImportedTransaction, error)
+	GetUnreconciledImports(basiqAccountID string) ([]ImportedTransaction, error)
+	GetPendingChanges() ([]ImportedTransaction, error)
+	GetVanishedForReview() ([]ImportedTransaction, error)
+	SetImportedReconciled(basiqTxID string) error
+	SetImportedState(basiqTxID, state, counterpart string) error
+	SetImportedMissed(basiqTxID string, missed int) error
+	SetPendingChange(basiqTxID, hash, payload string) error
+	IgnorePendingChange(basiqTxID string) error
+	UpdateImportedPayload(basiqTxID, hash, payload, postDate, amount string) error
+	DeleteImported(basiqTxID string) error
+
+	// Sync runs
+	StartRun(accounts int, tag string) (int64, error)
+	FinishRun(run SyncRun) error
+	SetRunStatus(id int64, status string) error
+	GetRun(id int64) (*SyncRun, error)
+	GetRuns(limit int) ([]SyncRun, error)
+	SaveRunAccount(ra SyncRunAccount) error
+	GetRunAccounts(runID int64) ([]SyncRunAccount, error)
+
+	// Jobs
+	EnqueueJob(jobType, payload string, scheduledAt time.Time, maxAttempts int) (int64, error)
+	LeaseJob(owner string, lease time.Duration) (*Job, error)
+	ExtendLease(id int64, owner string, lease time.Duration) error
+	CompleteJob(id int64) error
+	FailJob(id int64, errMsg string, retryAt time.Time) error
+	CancelJob(id int64) (bool, error)
+	GetJob(id int64) (*Job, error)
+	GetJobs(limit int) ([]Job, error)
+	PruneJobs(before time.Time) error
+
+	// Failed transactions
+	SaveFailedTransaction(f FailedTransaction) error
+	GetFailedTransactions(status string) ([]FailedTransaction, error)
+	GetFailedTransaction(id int64) (*FailedTransaction, error)
+	GetFailedTransactionByBasiqID(basiqID string) (*FailedTransaction, error)
+	GetRetryableTransactions(basiqAccountID string, maxAttempts int) ([]FailedTransaction, error)
+	CountFailedTransactions(status string) (int, error)
+	RecordFailedAttempt(id int64, errMsg string) error
+	SetFailedStatus(id int64, status string) error
+	UpdateFailedPayload(id int64, payload string) error
+
+	// Credit card repayment legs
+	SaveRepaymentLeg(paymentAccountID, amount, date, basiqTxID string) error
+	ClaimRepaymentLeg(paymentAccountID, amount, date, basiqTxID string, windowDays int) (bool, error)
+	DeleteRepaymentLeg(basiqTxID string) error
+
+	// Balance checks
+	SaveBalanceCheck(b BalanceCheck) error
+	GetBalanceChecks() (map[string]BalanceCheck, error)
+
+	// Matches held for review
+	SaveMatchReview(r MatchReview) error
+	GetMatchReview(basiqTxID string) (*MatchReview, error)
+	GetMatchReviews() ([]MatchReview, error)
+	DeleteMatchReview(basiqTxID string) error
+
+	// Import from the old PHP importer
+	GetLegacyImport() (*LegacyImport, error)
+	DismissLegacyImport() error
+
+	// Export, restore and backups
+	Export(credentials bool) (*Archive, error)
+	Restore(a *Archive, overwrite bool) (*RestoreReport, error)
+	BackupTo(dir string, keep int) (string, error)
+
+	// RotateKey encrypts every sensitive value with the current key
+	RotateKey() (int, error)
+
+	InTx(fn func(Store) error) error
+	Driver() string
+	SchemaVersion() (int, error)
+	Close() error
+}
+
+var _ Store = (*DB)(nil)